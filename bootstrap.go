@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/huikang/libnetwork-ovn-plugin/ovn"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// bootstrapFlags configure the chassis; they are accepted both by the
+// bootstrap command and globally for --bootstrap at startup
+var bootstrapFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "ovn-remote",
+		Usage:  "OVN southbound remote(s) for ovn-controller, e.g. tcp:IP:6642",
+		EnvVar: ovn.EnvPrefix + "OVN_REMOTE",
+	},
+	cli.StringFlag{
+		Name:   "ovn-nb",
+		Usage:  "OVN northbound remote(s) to record in external_ids:ovn-nb, e.g. tcp:IP:6641",
+		EnvVar: ovn.EnvPrefix + "OVN_NB",
+	},
+	cli.StringFlag{
+		Name:   "encap-ip",
+		Usage:  "tunnel endpoint IP of this host",
+		EnvVar: ovn.EnvPrefix + "ENCAP_IP",
+	},
+	cli.StringFlag{
+		Name:   "encap-iface",
+		Usage:  "interface to take the tunnel endpoint IP from",
+		EnvVar: ovn.EnvPrefix + "ENCAP_IFACE",
+	},
+	cli.StringFlag{
+		Name:   "cluster-advertise",
+		Usage:  "docker --cluster-advertise value (IFACE:PORT or IP:PORT) to take the tunnel endpoint IP from",
+		EnvVar: ovn.EnvPrefix + "CLUSTER_ADVERTISE",
+	},
+	cli.StringFlag{
+		Name:   "encap-type",
+		Value:  ovn.DefaultEncapType,
+		Usage:  "tunnel encapsulation type",
+		EnvVar: ovn.EnvPrefix + "ENCAP_TYPE",
+	},
+	cli.StringFlag{
+		Name:   "system-id",
+		Usage:  "chassis name (default: keep the current one or generate one)",
+		EnvVar: ovn.EnvPrefix + "SYSTEM_ID",
+	},
+}
+
+var bootstrapCommand = cli.Command{
+	Name:  "bootstrap",
+	Usage: "write the OVN chassis configuration into the local Open_vSwitch database",
+	Flags: bootstrapFlags,
+	Action: func(c *cli.Context) error {
+		if c.GlobalBool("debug") {
+			log.SetLevel(log.DebugLevel)
+		}
+		if err := bootstrap(c, c.String); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		return nil
+	},
+}
+
+// bootstrap configures the chassis from the flags read through get and
+// prints a report of the external_ids it verified
+func bootstrap(c *cli.Context, get func(string) string) error {
+	encapIP := get("encap-ip")
+	if encapIP == "" {
+		ip, err := ovn.ResolveEncapIP(get("encap-iface"), get("cluster-advertise"))
+		if err != nil {
+			return err
+		}
+		encapIP = ip
+	}
+
+	config := &ovn.ChassisConfig{
+		OvnRemote: get("ovn-remote"),
+		OvnNB:     get("ovn-nb"),
+		EncapIP:   encapIP,
+		EncapType: get("encap-type"),
+		SystemID:  get("system-id"),
+	}
+
+	results, err := ovn.Bootstrap(c.GlobalString("ovsdb"), sslConfig(c), config)
+	printBootstrapResults(results)
+	return err
+}
+
+func printBootstrapResults(results []ovn.BootstrapResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tPREVIOUS\tCURRENT\tSTATUS")
+	for _, res := range results {
+		status := "unchanged"
+		if res.Changed {
+			status = "updated"
+		}
+		if !res.Verified {
+			status = "FAILED"
+		}
+		fmt.Fprintf(w, "external_ids:%s\t%s\t%s\t%s\n", res.Key, res.Previous, res.Current, status)
+	}
+	w.Flush()
+}
@@ -0,0 +1,304 @@
+// Command ovn-cni is a CNI plugin wiring the containers of CNI runtimes,
+// e.g. containerd or Kubernetes, to OVN with the logic of the libnetwork
+// plugin. It implements the ADD, DEL, CHECK and VERSION commands of the CNI
+// specification 0.4.0 and delegates the addresses to the IPAM plugin of the
+// network configuration, or to ovn-northd when it has none.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/huikang/libnetwork-ovn-plugin/ovn"
+)
+
+const (
+	cniVersion = "0.4.0"
+
+	// errInternal is the CNI error code of the failures of the plugin
+	errInternal = 100
+)
+
+var supportedVersions = []string{"0.3.0", "0.3.1", "0.4.0"}
+
+// netConf is the CNI network configuration the plugin reads on stdin
+type netConf struct {
+	CNIVersion string          `json:"cniVersion"`
+	Name       string          `json:"name"`
+	Type       string          `json:"type"`
+	IPAM       json.RawMessage `json:"ipam,omitempty"`
+
+	// Switch is the logical switch, config bridge_prefix + name by default
+	Switch string `json:"switch,omitempty"`
+	// Subnet and Gateway of the network; ovn-northd assigns the addresses
+	// from Subnet without an IPAM plugin
+	Subnet  string `json:"subnet,omitempty"`
+	Gateway string `json:"gateway,omitempty"`
+	MTU     int    `json:"mtu,omitempty"`
+
+	// Remote is the OVN northbound remote, external_ids:ovn-nb of the local
+	// Open_vSwitch by default; OVSDB is the local Open_vSwitch database
+	Remote string `json:"remote,omitempty"`
+	OVSDB  string `json:"ovsdb,omitempty"`
+	// Config is the config file of the plugin
+	Config      string `json:"config,omitempty"`
+	PrivateKey  string `json:"private_key,omitempty"`
+	Certificate string `json:"certificate,omitempty"`
+	CACert      string `json:"ca_cert,omitempty"`
+	Debug       bool   `json:"debug,omitempty"`
+}
+
+type ipamConf struct {
+	Type string `json:"type"`
+}
+
+// args are the CNI_* environment variables of a call
+type args struct {
+	command     string
+	containerID string
+	netns       string
+	ifName      string
+	path        string
+}
+
+type cniError struct {
+	CNIVersion string `json:"cniVersion"`
+	Code       int    `json:"code"`
+	Msg        string `json:"msg"`
+}
+
+type iface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+type ipConfig struct {
+	Version   string `json:"version"`
+	Interface *int   `json:"interface,omitempty"`
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+}
+
+type route struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+type result struct {
+	CNIVersion string          `json:"cniVersion"`
+	Interfaces []iface         `json:"interfaces,omitempty"`
+	IPs        []ipConfig      `json:"ips,omitempty"`
+	Routes     []route         `json:"routes,omitempty"`
+	DNS        json.RawMessage `json:"dns,omitempty"`
+}
+
+func main() {
+	// CNI reads the result on stdout, the logs go to stderr
+	log.SetOutput(os.Stderr)
+	log.SetLevel(log.WarnLevel)
+
+	a := args{
+		command:     os.Getenv("CNI_COMMAND"),
+		containerID: os.Getenv("CNI_CONTAINERID"),
+		netns:       os.Getenv("CNI_NETNS"),
+		ifName:      os.Getenv("CNI_IFNAME"),
+		path:        os.Getenv("CNI_PATH"),
+	}
+	if a.command == "VERSION" {
+		printJSON(map[string]interface{}{"cniVersion": cniVersion, "supportedVersions": supportedVersions})
+		return
+	}
+
+	stdin, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fail(cniVersion, err)
+	}
+	var conf netConf
+	if err := json.Unmarshal(stdin, &conf); err != nil {
+		fail(cniVersion, fmt.Errorf("invalid network configuration: %s", err))
+	}
+	if conf.CNIVersion == "" {
+		conf.CNIVersion = cniVersion
+	}
+	if err := run(a, &conf, stdin); err != nil {
+		fail(conf.CNIVersion, err)
+	}
+}
+
+func run(a args, conf *netConf, stdin []byte) error {
+	if conf.Debug {
+		log.SetLevel(log.DebugLevel)
+	}
+	if a.containerID == "" || a.ifName == "" {
+		return fmt.Errorf("CNI_CONTAINERID and CNI_IFNAME are required")
+	}
+	config, err := ovn.LoadConfig(conf.Config)
+	if err != nil {
+		return err
+	}
+	if err := ovn.SetConfig(config); err != nil {
+		return err
+	}
+	var ipam ipamConf
+	if len(conf.IPAM) > 0 {
+		if err := json.Unmarshal(conf.IPAM, &ipam); err != nil {
+			return fmt.Errorf("invalid ipam configuration: %s", err)
+		}
+	}
+
+	c, err := ovn.NewCNI(conf.Remote, conf.OVSDB, &ovn.SSLConfig{
+		PrivateKey:  conf.PrivateKey,
+		Certificate: conf.Certificate,
+		CACert:      conf.CACert,
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	nw := &ovn.CNINetwork{
+		Name:    conf.Name,
+		Switch:  conf.Switch,
+		Subnet:  conf.Subnet,
+		Gateway: conf.Gateway,
+		MTU:     conf.MTU,
+	}
+	ep := &ovn.CNIEndpoint{
+		ContainerID: a.containerID,
+		Netns:       a.netns,
+		IfName:      a.ifName,
+	}
+
+	switch a.command {
+	case "ADD":
+		return add(a, conf, ipam, stdin, c, nw, ep)
+	case "DEL":
+		if err := c.Del(nw, ep); err != nil {
+			return err
+		}
+		if ipam.Type != "" {
+			_, err := execIPAM(a, ipam.Type, "DEL", stdin)
+			return err
+		}
+		return nil
+	case "CHECK":
+		if a.netns == "" {
+			return fmt.Errorf("CNI_NETNS is required")
+		}
+		if err := c.Check(nw, ep); err != nil {
+			return err
+		}
+		if ipam.Type != "" {
+			_, err := execIPAM(a, ipam.Type, "CHECK", stdin)
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown CNI_COMMAND [ %s ]", a.command)
+}
+
+func add(a args, conf *netConf, ipam ipamConf, stdin []byte, c *ovn.CNI, nw *ovn.CNINetwork, ep *ovn.CNIEndpoint) error {
+	if a.netns == "" {
+		return fmt.Errorf("CNI_NETNS is required")
+	}
+
+	var ipamResult result
+	if ipam.Type != "" {
+		out, err := execIPAM(a, ipam.Type, "ADD", stdin)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(out, &ipamResult); err != nil {
+			return fmt.Errorf("invalid result of ipam plugin [ %s ]: %s", ipam.Type, err)
+		}
+		for _, ip := range ipamResult.IPs {
+			if ip.Version == "4" || (ip.Version == "" && !strings.Contains(ip.Address, ":")) {
+				ep.Address = ip.Address
+				if nw.Gateway == "" {
+					nw.Gateway = ip.Gateway
+				}
+				break
+			}
+		}
+		if ep.Address == "" {
+			execIPAM(a, ipam.Type, "DEL", stdin)
+			return fmt.Errorf("ipam plugin [ %s ] returned no IPv4 address", ipam.Type)
+		}
+	}
+
+	att, err := c.Add(nw, ep)
+	if err != nil {
+		if ipam.Type != "" {
+			execIPAM(a, ipam.Type, "DEL", stdin)
+		}
+		return err
+	}
+
+	index := 1
+	res := result{
+		CNIVersion: conf.CNIVersion,
+		Interfaces: []iface{
+			{Name: att.HostInterface, Mac: att.HostMAC},
+			{Name: att.Interface, Mac: att.MAC, Sandbox: a.netns},
+		},
+		IPs: []ipConfig{{Version: "4", Interface: &index, Address: att.Address, Gateway: att.Gateway}},
+		DNS: ipamResult.DNS,
+	}
+	if att.Gateway != "" {
+		res.Routes = []route{{Dst: "0.0.0.0/0", GW: att.Gateway}}
+	}
+	printJSON(res)
+	return nil
+}
+
+// execIPAM runs the IPAM plugin named typ from CNI_PATH with the same
+// environment and network configuration, as the CNI delegation does
+func execIPAM(a args, typ, command string, stdin []byte) ([]byte, error) {
+	var plugin string
+	for _, dir := range filepath.SplitList(a.path) {
+		if p := filepath.Join(dir, typ); isExecutable(p) {
+			plugin = p
+			break
+		}
+	}
+	if plugin == "" {
+		return nil, fmt.Errorf("failed to find ipam plugin [ %s ] in CNI_PATH [ %s ]", typ, a.path)
+	}
+
+	cmd := exec.Command(plugin)
+	cmd.Env = append(os.Environ(), "CNI_COMMAND="+command)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		var e cniError
+		if json.Unmarshal(out, &e) == nil && e.Msg != "" {
+			return nil, fmt.Errorf("ipam plugin [ %s ]: %s", typ, e.Msg)
+		}
+		return nil, fmt.Errorf("ipam plugin [ %s ]: %s", typ, err)
+	}
+	return out, nil
+}
+
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir() && info.Mode()&0111 != 0
+}
+
+func printJSON(v interface{}) {
+	json.NewEncoder(os.Stdout).Encode(v)
+}
+
+// fail prints err as a CNI error and exits
+func fail(version string, err error) {
+	printJSON(cniError{CNIVersion: version, Code: errInternal, Msg: err.Error()})
+	os.Exit(1)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/huikang/libnetwork-ovn-plugin/ovn"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var diagnoseCommand = cli.Command{
+	Name:      "diagnose",
+	Usage:     "check every hop of the data path of a container endpoint on this host",
+	ArgsUsage: "CONTAINER|ENDPOINT",
+	Flags:     append(inspectFlags, networkFlag),
+	Action:    withInspector(diagnose),
+}
+
+// diagnose prints a pass/fail report of the checks of an endpoint and
+// fails when any check does
+func diagnose(c *cli.Context, i *ovn.Inspector) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("diagnose needs a container or endpoint")
+	}
+	d, err := i.Diagnose(c.Args().First(), c.String("network"))
+	if err != nil {
+		return err
+	}
+
+	if c.String("format") == formatJSON {
+		if err := printJSON(d); err != nil {
+			return err
+		}
+	} else {
+		ep := d.Endpoint
+		fmt.Printf("Endpoint of %s on %s: %s %s, logical port %s\n\n", ep.Container, ep.Network, ep.IP, ep.MAC, ep.LogicalPort)
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "CHECK\tRESULT\tDETAIL")
+		for _, check := range d.Checks {
+			result := "PASS"
+			if check.Skipped {
+				result = "SKIP"
+			} else if !check.Passed {
+				result = "FAIL"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", check.Name, result, check.Detail)
+		}
+		w.Flush()
+
+		for _, check := range d.Checks {
+			if !check.Passed && !check.Skipped {
+				fmt.Printf("\n%s: %s", check.Name, check.Hint)
+			}
+		}
+		fmt.Println()
+	}
+
+	if !d.Passed() {
+		return fmt.Errorf("some checks failed")
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/go-plugins-helpers/sdk"
+)
+
+// pluginManifest declares both drivers on the plugin socket, which the
+// handlers of go-plugins-helpers can only do for one of them
+const pluginManifest = `{"Implements": ["NetworkDriver", "IpamDriver"]}`
+
+// decodeFunc decodes the body of a plugin API request into req
+type decodeFunc func(req interface{}) error
+
+// newPluginHandler serves the network driver d and the IPAM driver i on the
+// same plugin API
+func newPluginHandler(d network.Driver, i ipam.Ipam) sdk.Handler {
+	h := sdk.NewHandler(pluginManifest)
+
+	handle(h, "/NetworkDriver.GetCapabilities", func(decode decodeFunc) (interface{}, error) {
+		return d.GetCapabilities()
+	})
+	handle(h, "/NetworkDriver.CreateNetwork", func(decode decodeFunc) (interface{}, error) {
+		req := &network.CreateNetworkRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, d.CreateNetwork(req)
+	})
+	handle(h, "/NetworkDriver.AllocateNetwork", func(decode decodeFunc) (interface{}, error) {
+		req := &network.AllocateNetworkRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return d.AllocateNetwork(req)
+	})
+	handle(h, "/NetworkDriver.DeleteNetwork", func(decode decodeFunc) (interface{}, error) {
+		req := &network.DeleteNetworkRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, d.DeleteNetwork(req)
+	})
+	handle(h, "/NetworkDriver.FreeNetwork", func(decode decodeFunc) (interface{}, error) {
+		req := &network.FreeNetworkRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, d.FreeNetwork(req)
+	})
+	handle(h, "/NetworkDriver.CreateEndpoint", func(decode decodeFunc) (interface{}, error) {
+		req := &network.CreateEndpointRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return d.CreateEndpoint(req)
+	})
+	handle(h, "/NetworkDriver.DeleteEndpoint", func(decode decodeFunc) (interface{}, error) {
+		req := &network.DeleteEndpointRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, d.DeleteEndpoint(req)
+	})
+	handle(h, "/NetworkDriver.EndpointOperInfo", func(decode decodeFunc) (interface{}, error) {
+		req := &network.InfoRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return d.EndpointInfo(req)
+	})
+	handle(h, "/NetworkDriver.Join", func(decode decodeFunc) (interface{}, error) {
+		req := &network.JoinRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return d.Join(req)
+	})
+	handle(h, "/NetworkDriver.Leave", func(decode decodeFunc) (interface{}, error) {
+		req := &network.LeaveRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, d.Leave(req)
+	})
+	handle(h, "/NetworkDriver.DiscoverNew", func(decode decodeFunc) (interface{}, error) {
+		req := &network.DiscoveryNotification{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, d.DiscoverNew(req)
+	})
+	handle(h, "/NetworkDriver.DiscoverDelete", func(decode decodeFunc) (interface{}, error) {
+		req := &network.DiscoveryNotification{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, d.DiscoverDelete(req)
+	})
+	handle(h, "/NetworkDriver.ProgramExternalConnectivity", func(decode decodeFunc) (interface{}, error) {
+		req := &network.ProgramExternalConnectivityRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, d.ProgramExternalConnectivity(req)
+	})
+	handle(h, "/NetworkDriver.RevokeExternalConnectivity", func(decode decodeFunc) (interface{}, error) {
+		req := &network.RevokeExternalConnectivityRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, d.RevokeExternalConnectivity(req)
+	})
+
+	handle(h, "/IpamDriver.GetCapabilities", func(decode decodeFunc) (interface{}, error) {
+		return i.GetCapabilities()
+	})
+	handle(h, "/IpamDriver.GetDefaultAddressSpaces", func(decode decodeFunc) (interface{}, error) {
+		return i.GetDefaultAddressSpaces()
+	})
+	handle(h, "/IpamDriver.RequestPool", func(decode decodeFunc) (interface{}, error) {
+		req := &ipam.RequestPoolRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return i.RequestPool(req)
+	})
+	handle(h, "/IpamDriver.ReleasePool", func(decode decodeFunc) (interface{}, error) {
+		req := &ipam.ReleasePoolRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, i.ReleasePool(req)
+	})
+	handle(h, "/IpamDriver.RequestAddress", func(decode decodeFunc) (interface{}, error) {
+		req := &ipam.RequestAddressRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return i.RequestAddress(req)
+	})
+	handle(h, "/IpamDriver.ReleaseAddress", func(decode decodeFunc) (interface{}, error) {
+		req := &ipam.ReleaseAddressRequest{}
+		if err := decode(req); err != nil {
+			return nil, err
+		}
+		return nil, i.ReleaseAddress(req)
+	})
+	return h
+}
+
+// handle serves path with call. A request that can not be decoded has been
+// answered already; a call without response gets an empty JSON object.
+func handle(h sdk.Handler, path string, call func(decode decodeFunc) (interface{}, error)) {
+	h.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		decoded := true
+		decode := func(req interface{}) error {
+			err := sdk.DecodeRequest(w, r, req)
+			decoded = err == nil
+			return err
+		}
+
+		res, err := call(decode)
+		if !decoded {
+			return
+		}
+		if err != nil {
+			msg := err.Error()
+			sdk.EncodeResponse(w, &network.ErrorResponse{Err: msg}, msg)
+			return
+		}
+		if res == nil {
+			res = make(map[string]string)
+		}
+		sdk.EncodeResponse(w, res, "")
+	})
+}
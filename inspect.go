@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/huikang/libnetwork-ovn-plugin/ovn"
+	"gopkg.in/urfave/cli.v1"
+)
+
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+)
+
+// inspectFlags are accepted by the commands reading what the plugin manages
+var inspectFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "sb-remote",
+		Usage:  "OVN southbound remote(s) to read the port bindings from (default: external_ids:ovn-remote of the local Open_vSwitch)",
+		EnvVar: ovn.EnvPrefix + "SB_REMOTE",
+	},
+	cli.StringFlag{
+		Name:  "format, f",
+		Value: formatTable,
+		Usage: "output format: table or json",
+	},
+}
+
+var networksCommand = cli.Command{
+	Name:  "networks",
+	Usage: "list and inspect the networks of the plugin",
+	Subcommands: []cli.Command{
+		{
+			Name:   "ls",
+			Usage:  "list the networks with their logical switches",
+			Flags:  inspectFlags,
+			Action: withInspector(listNetworks),
+		},
+		{
+			Name:      "inspect",
+			Usage:     "show a network, its logical switch and its endpoints",
+			ArgsUsage: "NETWORK",
+			Flags:     inspectFlags,
+			Action:    withInspector(inspectNetwork),
+		},
+	},
+}
+
+var endpointsCommand = cli.Command{
+	Name:  "endpoints",
+	Usage: "list and inspect the container endpoints of the plugin on this host",
+	Subcommands: []cli.Command{
+		{
+			Name:   "ls",
+			Usage:  "list the endpoints with their logical ports, OVS interfaces and bindings",
+			Flags:  append(inspectFlags, networkFlag),
+			Action: withInspector(listEndpoints),
+		},
+		{
+			Name:      "inspect",
+			Usage:     "show the endpoint of a container",
+			ArgsUsage: "CONTAINER|ENDPOINT",
+			Flags:     append(inspectFlags, networkFlag),
+			Action:    withInspector(inspectEndpoint),
+		},
+	},
+}
+
+var servicesCommand = cli.Command{
+	Name:  "services",
+	Usage: "list the services load-balanced by OVN",
+	Subcommands: []cli.Command{
+		{
+			Name:   "ls",
+			Usage:  "list the services with their VIPs, backends and backend health",
+			Flags:  append(inspectFlags, networkFlag),
+			Action: withInspector(listServices),
+		},
+	},
+}
+
+var networkFlag = cli.StringFlag{
+	Name:  "network, n",
+	Usage: "only the endpoints of this network",
+}
+
+// withInspector runs action with an inspector connected as the global flags
+// and the config say
+func withInspector(action func(c *cli.Context, i *ovn.Inspector) error) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		if format := c.String("format"); format != formatTable && format != formatJSON {
+			return cli.NewExitError(fmt.Sprintf("unknown format [ %s ]", format), 1)
+		}
+		if err := loadConfig(c); err != nil {
+			return err
+		}
+		i, err := ovn.NewInspector(c.GlobalString("remote"), c.String("sb-remote"), c.GlobalString("ovsdb"), sslConfig(c))
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		defer i.Close()
+		if err := action(c, i); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		return nil
+	}
+}
+
+func listNetworks(c *cli.Context, i *ovn.Inspector) error {
+	networks, err := i.Networks()
+	if err != nil {
+		return err
+	}
+	if c.String("format") == formatJSON {
+		return printJSON(networks)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tID\tLOGICAL SWITCH\tSUBNET\tGATEWAY\tENDPOINTS\tPORTS")
+	for _, n := range networks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\n", n.Name, shortID(n.ID), switchStatus(n),
+			orDash(n.Subnet), orDash(n.Gateway), len(n.Endpoints), n.Ports)
+	}
+	return w.Flush()
+}
+
+func inspectNetwork(c *cli.Context, i *ovn.Inspector) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("networks inspect needs a network name or id")
+	}
+	n, err := i.Network(c.Args().First())
+	if err != nil {
+		return err
+	}
+	if c.String("format") == formatJSON {
+		return printJSON(n)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	printFields(w, [][2]string{
+		{"Name", n.Name},
+		{"ID", n.ID},
+		{"Logical switch", switchStatus(n)},
+		{"Subnet", n.Subnet},
+		{"Gateway", n.Gateway},
+		{"Tenant", n.Tenant},
+		{"Logical ports", strconv.Itoa(n.Ports)},
+	})
+	fmt.Fprintln(w)
+	printEndpoints(w, n.Endpoints)
+	return w.Flush()
+}
+
+func listEndpoints(c *cli.Context, i *ovn.Inspector) error {
+	var endpoints []*ovn.EndpointView
+	var err error
+	if network := c.String("network"); network != "" {
+		var n *ovn.NetworkView
+		if n, err = i.Network(network); err == nil {
+			endpoints = n.Endpoints
+		}
+	} else {
+		endpoints, err = i.Endpoints()
+	}
+	if err != nil {
+		return err
+	}
+	if c.String("format") == formatJSON {
+		if endpoints == nil {
+			endpoints = []*ovn.EndpointView{}
+		}
+		return printJSON(endpoints)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	printEndpoints(w, endpoints)
+	return w.Flush()
+}
+
+func inspectEndpoint(c *cli.Context, i *ovn.Inspector) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("endpoints inspect needs a container or endpoint")
+	}
+	ep, err := i.Endpoint(c.Args().First(), c.String("network"))
+	if err != nil {
+		return err
+	}
+	if c.String("format") == formatJSON {
+		return printJSON(ep)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	printFields(w, [][2]string{
+		{"Container", ep.Container + " (" + shortID(ep.ContainerID) + ")"},
+		{"Network", ep.Network + " (" + shortID(ep.NetworkID) + ")"},
+		{"Endpoint", ep.EndpointID},
+		{"IP", ep.IP},
+		{"MAC", ep.MAC},
+		{"Logical switch", ep.LogicalSwitch},
+		{"Logical port", portStatus(ep)},
+		{"Addresses", strings.Join(ep.Addresses, ", ")},
+		{"Dynamic addresses", ep.DynamicAddresses},
+		{"Up", strconv.FormatBool(ep.Up)},
+		{"OVS interface", ep.Interface},
+		{"OpenFlow port", ofport(ep)},
+		{"Link state", ep.LinkState},
+		{"Veth", ep.Veth + " (" + ep.VethState + ")"},
+		{"Veth peer", ep.VethPeer},
+		{"Chassis", chassis(ep)},
+	})
+	return w.Flush()
+}
+
+func listServices(c *cli.Context, i *ovn.Inspector) error {
+	services, err := i.Services(c.String("network"))
+	if err != nil {
+		return err
+	}
+	if c.String("format") == formatJSON {
+		return printJSON(services)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tNETWORK\tVIPS\tBACKEND\tLOGICAL PORT\tHEALTH")
+	for _, s := range services {
+		vips := strings.Join(s.VIPs, ",")
+		if len(s.Backends) == 0 {
+			fmt.Fprintf(w, "%s\t%s\t%s\t-\t-\t-\n", s.Name, s.Network, vips)
+		}
+		for _, b := range s.Backends {
+			backend := b.IP
+			if b.Port != 0 {
+				backend += ":" + strconv.Itoa(b.Port)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", s.Name, s.Network, vips, backend, orDash(b.LogicalPort), orDash(b.Status))
+		}
+	}
+	return w.Flush()
+}
+
+func printEndpoints(w io.Writer, endpoints []*ovn.EndpointView) {
+	fmt.Fprintln(w, "CONTAINER\tNETWORK\tIP\tMAC\tLOGICAL PORT\tUP\tOFPORT\tVETH\tCHASSIS")
+	for _, ep := range endpoints {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%t\t%s\t%s\t%s\n", ep.Container, ep.Network, orDash(ep.IP), orDash(ep.MAC),
+			portStatus(ep), ep.Up, ofport(ep), ep.Veth+" ("+ep.VethState+")", chassis(ep))
+	}
+}
+
+func printFields(w io.Writer, fields [][2]string) {
+	for _, f := range fields {
+		fmt.Fprintf(w, "%s:\t%s\n", f[0], orDash(f[1]))
+	}
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func switchStatus(n *ovn.NetworkView) string {
+	if !n.SwitchFound {
+		return n.LogicalSwitch + " (missing)"
+	}
+	return n.LogicalSwitch
+}
+
+func portStatus(ep *ovn.EndpointView) string {
+	if !ep.PortFound {
+		return ep.LogicalPort + " (missing)"
+	}
+	return ep.LogicalPort
+}
+
+func ofport(ep *ovn.EndpointView) string {
+	if ep.OFPort < 0 {
+		return "-"
+	}
+	return strconv.Itoa(ep.OFPort)
+}
+
+func chassis(ep *ovn.EndpointView) string {
+	if ep.ChassisHostname != "" {
+		return ep.ChassisHostname
+	}
+	return orDash(ep.Chassis)
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"net"
+	"net/http"
 	"os"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/docker/go-plugins-helpers/network"
 	"github.com/huikang/libnetwork-ovn-plugin/ovn"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gopkg.in/urfave/cli.v1"
 )
 
@@ -21,14 +24,72 @@ func main() {
 
 	app.Flags = []cli.Flag{
 		cli.BoolFlag{
-			Name:  "debug, d",
-			Usage: "enabling debugging",
+			Name:   "debug, d",
+			Usage:  "enabling debugging",
+			EnvVar: ovn.EnvPrefix + "DEBUG",
 		},
 		cli.StringFlag{
-			Name:  "remote, r",
-			Value: ovn.Localhost,
-			Usage: "IP of OVN northound",
+			Name:   "remote, r",
+			Usage:  "OVN northbound remote(s), comma-separated for a cluster: ssl:IP:PORT, tcp:IP:PORT, unix:FILE or a bare IP (default: external_ids:ovn-nb of the local Open_vSwitch)",
+			EnvVar: ovn.EnvPrefix + "REMOTE",
 		},
+		cli.StringFlag{
+			Name:   "config, c",
+			Usage:  "YAML (or .toml) config file; OVN_PLUGIN_* environment variables override its settings",
+			EnvVar: ovn.EnvPrefix + "CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "ovsdb",
+			Value:  ovn.DefaultOvsdbRemote,
+			Usage:  "local Open_vSwitch database remote: unix:FILE, tcp:IP:PORT or ssl:IP:PORT",
+			EnvVar: ovn.EnvPrefix + "OVSDB",
+		},
+		cli.StringFlag{
+			Name:   "private-key",
+			Usage:  "private key file for ssl remotes",
+			EnvVar: ovn.EnvPrefix + "PRIVATE_KEY",
+		},
+		cli.StringFlag{
+			Name:   "certificate",
+			Usage:  "certificate file for ssl remotes",
+			EnvVar: ovn.EnvPrefix + "CERTIFICATE",
+		},
+		cli.StringFlag{
+			Name:   "ca-cert",
+			Usage:  "CA certificate file for ssl remotes",
+			EnvVar: ovn.EnvPrefix + "CA_CERT",
+		},
+		cli.StringFlag{
+			Name:   "health-addr",
+			Usage:  "serve /healthz and /readyz on this address: IP:PORT or unix:FILE",
+			EnvVar: ovn.EnvPrefix + "HEALTH_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "metrics-addr",
+			Usage:  "serve prometheus metrics on /metrics at this address: IP:PORT or unix:FILE",
+			EnvVar: ovn.EnvPrefix + "METRICS_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "audit-file",
+			Usage:  "append a JSON line to this file for every change made to OVN, OVS and host links",
+			EnvVar: ovn.EnvPrefix + "AUDIT_FILE",
+		},
+		cli.BoolFlag{
+			Name:   "bootstrap",
+			Usage:  "configure the chassis as the bootstrap command does before serving",
+			EnvVar: ovn.EnvPrefix + "BOOTSTRAP",
+		},
+	}
+	app.Flags = append(app.Flags, serveFlags...)
+	app.Flags = append(app.Flags, bootstrapFlags...)
+
+	app.Commands = []cli.Command{
+		bootstrapCommand,
+		pluginConfigCommand,
+		networksCommand,
+		endpointsCommand,
+		servicesCommand,
+		diagnoseCommand,
 	}
 
 	app.Action = pluginServer
@@ -41,16 +102,88 @@ func pluginServer(c *cli.Context) error {
 		log.SetLevel(log.DebugLevel)
 	}
 
-	nbip := c.GlobalString("remote")
-	log.Debugf("remote ip [ %s ]", nbip)
-	// fixme: validate nbip
+	nbRemote := c.GlobalString("remote")
+	log.Debugf("remote [ %s ]", nbRemote)
+
+	ovsdbRemote := c.GlobalString("ovsdb")
+	log.Debugf("ovsdb [ %s ]", ovsdbRemote)
+
+	if err := loadConfig(c); err != nil {
+		return err
+	}
+
+	if path := c.GlobalString("audit-file"); path != "" {
+		if err := ovn.OpenAuditLog(path); err != nil {
+			panic(err)
+		}
+	}
+
+	if c.GlobalBool("bootstrap") {
+		if err := bootstrap(c, c.GlobalString); err != nil {
+			panic(err)
+		}
+	}
 
-	d, err := ovn.NewDriver(nbip)
+	d, err := ovn.NewDriver(nbRemote, ovsdbRemote, sslConfig(c))
 	if err != nil {
 		panic(err)
 	}
 
-	h := network.NewHandler(d)
-	h.ServeUnix(ovn.DriverName, 0)
+	if addr := c.GlobalString("health-addr"); addr != "" {
+		l, err := listen(addr)
+		if err != nil {
+			panic(err)
+		}
+		log.Infof("Serving health checks on [ %s ]", addr)
+		go http.Serve(l, d.HealthHandler())
+	}
+
+	if addr := c.GlobalString("metrics-addr"); addr != "" {
+		ovn.RegisterMetrics(d)
+		l, err := listen(addr)
+		if err != nil {
+			panic(err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		log.Infof("Serving metrics on [ %s ]", addr)
+		go http.Serve(l, mux)
+	}
+
+	h := newPluginHandler(ovn.Instrument(d), ovn.NewIPAM(d))
+	if err := servePlugin(c, h); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}
+
+// loadConfig makes the config file and the environment the plugin-wide
+// configuration
+func loadConfig(c *cli.Context) error {
+	config, err := ovn.LoadConfig(c.GlobalString("config"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err := ovn.SetConfig(config); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
 	return nil
 }
+
+func sslConfig(c *cli.Context) *ovn.SSLConfig {
+	return &ovn.SSLConfig{
+		PrivateKey:  c.GlobalString("private-key"),
+		Certificate: c.GlobalString("certificate"),
+		CACert:      c.GlobalString("ca-cert"),
+	}
+}
+
+// listen opens a listener on a unix:FILE or TCP IP:PORT address
+func listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		os.Remove(path)
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
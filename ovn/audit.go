@@ -0,0 +1,139 @@
+package ovn
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/socketplane/libovsdb"
+)
+
+var (
+	auditFile *os.File
+	auditMu   sync.Mutex // guards auditFile
+)
+
+// request is the Docker request, or the internal task, on whose behalf the
+// plugin changes OVN, OVS or the host links. Every change is logged and
+// audited with its correlation id.
+type request struct {
+	id         string
+	method     string
+	networkID  string
+	endpointID string
+	log        *log.Entry
+}
+
+// auditRecord is one line of the audit file
+type auditRecord struct {
+	Time       time.Time            `json:"time"`
+	RequestID  string               `json:"request_id"`
+	Method     string               `json:"method"`
+	NetworkID  string               `json:"network_id,omitempty"`
+	EndpointID string               `json:"endpoint_id,omitempty"`
+	Kind       string               `json:"kind"`
+	Database   string               `json:"database,omitempty"`
+	Operations []libovsdb.Operation `json:"operations,omitempty"`
+	Action     string               `json:"action,omitempty"`
+	Link       string               `json:"link,omitempty"`
+	Error      string               `json:"error,omitempty"`
+}
+
+// OpenAuditLog appends an audit record as a JSON line to path for every
+// transaction and netlink change the plugin makes
+func OpenAuditLog(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	auditMu.Lock()
+	auditFile = f
+	auditMu.Unlock()
+	log.Infof("Writing the audit log to [ %s ]", path)
+	return nil
+}
+
+// newRequest gives a new correlation id to a request for method on the
+// given network and endpoint, which may be empty
+func newRequest(method, networkID, endpointID string) *request {
+	id, err := newUUID()
+	if err != nil {
+		id = time.Now().Format("20060102150405.000000000")
+	}
+	fields := log.Fields{
+		"request_id": id,
+		"method":     method,
+	}
+	if networkID != "" {
+		fields["network_id"] = networkID
+	}
+	if endpointID != "" {
+		fields["endpoint_id"] = endpointID
+	}
+	return &request{
+		id:         id,
+		method:     method,
+		networkID:  networkID,
+		endpointID: endpointID,
+		log:        log.WithFields(fields),
+	}
+}
+
+func (r *request) record(kind string) *auditRecord {
+	return &auditRecord{
+		Time:       time.Now().UTC(),
+		RequestID:  r.id,
+		Method:     r.method,
+		NetworkID:  r.networkID,
+		EndpointID: r.endpointID,
+		Kind:       kind,
+	}
+}
+
+// auditTransaction logs an OVSDB transaction made for the request
+func (r *request) auditTransaction(database string, operations []libovsdb.Operation, err error) {
+	rec := r.record("ovsdb")
+	rec.Database = database
+	rec.Operations = operations
+	entry := r.log.WithField("database", database)
+	for _, o := range operations {
+		entry.Infof("%s [ %s ] where %v", o.Op, o.Table, o.Where)
+	}
+	if err != nil {
+		rec.Error = err.Error()
+		entry.Errorf("Transaction failed: [ %s ]", err)
+	}
+	writeAudit(rec)
+}
+
+// auditLink logs a netlink change of link made for the request
+func (r *request) auditLink(action, link string, err error) {
+	rec := r.record("netlink")
+	rec.Action = action
+	rec.Link = link
+	entry := r.log.WithField("link", link)
+	entry.Infof("netlink %s", action)
+	if err != nil {
+		rec.Error = err.Error()
+		entry.Errorf("netlink %s failed: [ %s ]", action, err)
+	}
+	writeAudit(rec)
+}
+
+func writeAudit(rec *auditRecord) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditFile == nil {
+		return
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Errorf("could not encode audit record: %s", err)
+		return
+	}
+	if _, err := auditFile.Write(append(line, '\n')); err != nil {
+		log.Errorf("could not write audit record: %s", err)
+	}
+}
@@ -0,0 +1,196 @@
+package ovn
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/socketplane/libovsdb"
+)
+
+// DefaultEncapType is the default tunnel encapsulation of the chassis
+const DefaultEncapType = "geneve"
+
+// ChassisConfig is the ovn-controller configuration of a chassis, stored in
+// the external_ids of the local Open_vSwitch table. Empty fields are left
+// untouched.
+type ChassisConfig struct {
+	OvnRemote string // ovn-remote, the OVN Southbound database
+	OvnNB     string // ovn-nb, the OVN Northbound database
+	EncapIP   string // ovn-encap-ip
+	EncapType string // ovn-encap-type
+	SystemID  string // system-id, the chassis name
+}
+
+// BootstrapResult is the outcome of bootstrapping one external_ids key
+type BootstrapResult struct {
+	Key      string
+	Previous string
+	Current  string
+	Changed  bool
+	Verified bool
+}
+
+func (c *ChassisConfig) externalIDs() map[string]string {
+	ids := make(map[string]string)
+	for k, v := range map[string]string{
+		"ovn-remote":     c.OvnRemote,
+		"ovn-nb":         c.OvnNB,
+		"ovn-encap-ip":   c.EncapIP,
+		"ovn-encap-type": c.EncapType,
+		"system-id":      c.SystemID,
+	} {
+		if v != "" {
+			ids[k] = v
+		}
+	}
+	return ids
+}
+
+// ResolveEncapIP returns the tunnel endpoint IP of this host, taken from the
+// given interface, or else from the host part of a docker
+// --cluster-advertise value, which is either an IP or an interface name
+// followed by a port (e.g. "eth0:2376")
+func ResolveEncapIP(iface, clusterAdvertise string) (string, error) {
+	if iface == "" && clusterAdvertise != "" {
+		host, _, err := net.SplitHostPort(clusterAdvertise)
+		if err != nil {
+			host = clusterAdvertise
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			return ip.String(), nil
+		}
+		iface = host
+	}
+	if iface == "" {
+		return "", nil
+	}
+	addr, err := getIfaceAddr(iface)
+	if err != nil {
+		return "", fmt.Errorf("could not get the address of interface [ %s ]: %s", iface, err)
+	}
+	return addr.IP.String(), nil
+}
+
+// Bootstrap writes the chassis configuration into the local Open_vSwitch
+// database reached through ovsdbRemote and reports the result for every key.
+// Keys that already hold the wanted value are not rewritten, so running it
+// again is harmless. A system-id is generated if none is set yet.
+func Bootstrap(ovsdbRemote string, sslConfig *SSLConfig, config *ChassisConfig) ([]BootstrapResult, error) {
+	r, err := parseRemote(ovsdbRemote, ovsdbPort)
+	if err != nil {
+		return nil, err
+	}
+	client, err := connectRemote(r, sslConfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to OVSDB [ %s ]: %s", r, err)
+	}
+	defer client.Disconnect()
+	ovsdber := &ovsdber{ovsdb: client}
+
+	row, err := ovsdber.getOpenvSwitchRow()
+	if err != nil {
+		return nil, err
+	}
+	rootUUID := getRowUUID(row)
+	previous := getRowMap(row, "external_ids")
+
+	wanted := config.externalIDs()
+	if _, ok := wanted["system-id"]; !ok && previous["system-id"] == "" {
+		systemID, err := newUUID()
+		if err != nil {
+			return nil, err
+		}
+		wanted["system-id"] = systemID
+	}
+
+	changed := make(map[string]string)
+	for k, v := range wanted {
+		if previous[k] != v {
+			changed[k] = v
+		}
+	}
+	if len(changed) > 0 {
+		if err := ovsdber.setExternalIDs(newRequest("Bootstrap", "", ""), rootUUID, changed); err != nil {
+			return nil, err
+		}
+		log.Infof("Updated external_ids %v of the local Open_vSwitch", changed)
+	}
+
+	current, err := ovsdber.getExternalIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []BootstrapResult
+	for k, v := range wanted {
+		_, isChanged := changed[k]
+		results = append(results, BootstrapResult{
+			Key:      k,
+			Previous: previous[k],
+			Current:  current[k],
+			Changed:  isChanged,
+			Verified: current[k] == v,
+		})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+
+	for _, res := range results {
+		if !res.Verified {
+			return results, fmt.Errorf("external_ids:%s is [ %s ] after bootstrap, expected [ %s ]", res.Key, res.Current, wanted[res.Key])
+		}
+	}
+	return results, nil
+}
+
+// setExternalIDs replaces the given keys in the external_ids of the
+// Open_vSwitch row rootUUID
+func (ovsdber *ovsdber) setExternalIDs(r *request, rootUUID string, ids map[string]string) error {
+	var keys []string
+	for k := range ids {
+		keys = append(keys, k)
+	}
+	deleteSet, _ := libovsdb.NewOvsSet(keys)
+	deleteMutation := libovsdb.NewMutation("external_ids", "delete", deleteSet)
+	insertMap, _ := libovsdb.NewOvsMap(ids)
+	insertMutation := libovsdb.NewMutation("external_ids", "insert", insertMap)
+	condition := libovsdb.NewCondition("_uuid", "==", libovsdb.UUID{GoUUID: rootUUID})
+
+	// The mutations are applied in order: drop the old values, then insert
+	mutateOp := libovsdb.Operation{
+		Op:        "mutate",
+		Table:     "Open_vSwitch",
+		Mutations: []interface{}{deleteMutation, insertMutation},
+		Where:     []interface{}{condition},
+	}
+
+	operations := []libovsdb.Operation{mutateOp}
+	reply, err := transact(r, ovsdber.ovsdb, "Open_vSwitch", operations...)
+	if err != nil {
+		return err
+	}
+
+	if len(reply) < len(operations) {
+		return errors.New("Number of Replies should be at least equal to number of Operations")
+	}
+	for _, o := range reply {
+		if o.Error != "" {
+			return errors.New("Transaction Failed due to an error :" + o.Error + " details : " + o.Details)
+		}
+	}
+	return nil
+}
+
+// newUUID generates a random (version 4) UUID
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,152 @@
+package ovn
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/socketplane/libovsdb"
+)
+
+// parseRemotes parses a comma-separated list of OVSDB remotes, e.g. the
+// members of a clustered database
+func parseRemotes(s string, defaultPort int) ([]remote, error) {
+	var remotes []remote
+	for _, part := range strings.Split(s, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		r, err := parseRemote(part, defaultPort)
+		if err != nil {
+			return nil, err
+		}
+		remotes = append(remotes, r)
+	}
+	if len(remotes) == 0 {
+		return nil, fmt.Errorf("no OVSDB remote in [ %s ]", s)
+	}
+	return remotes, nil
+}
+
+// isNBLeader reports whether client is connected to a server that accepts
+// OVN_Northbound writes: either a standalone server or the leader of a
+// clustered database that is connected to the rest of the cluster.
+func isNBLeader(client *libovsdb.OvsdbClient) (bool, error) {
+	// ovsdb-server before 2.9 has no _Server database and no clustering
+	if _, ok := client.Schema["_Server"]; !ok {
+		return true, nil
+	}
+
+	condition := libovsdb.NewCondition("name", "==", "OVN_Northbound")
+	selectOp := libovsdb.Operation{
+		Op:    "select",
+		Table: "Database",
+		Where: []interface{}{condition},
+	}
+	operations := []libovsdb.Operation{selectOp}
+	reply, err := client.Transact("_Server", operations...)
+	if err != nil {
+		return false, err
+	}
+
+	if len(reply) < len(operations) {
+		return false, errors.New("Number of Replies should be at least equal to number of Operations")
+	}
+
+	if reply[0].Error != "" {
+		return false, errors.New("Transaction Failed due to an error :" + reply[0].Error + " details : " + reply[0].Details)
+	}
+
+	if len(reply[0].Rows) == 0 {
+		return false, errors.New("server does not serve OVN_Northbound")
+	}
+
+	row := reply[0].Rows[0]
+	if model, _ := row["model"].(string); model != "clustered" {
+		return true, nil
+	}
+	connected, _ := row["connected"].(bool)
+	leader, _ := row["leader"].(bool)
+	return connected && leader, nil
+}
+
+// connectLeader tries every northbound remote once, starting after the one
+// used last, and returns a connection to the first standalone server or
+// cluster leader it finds
+func (ovnnber *ovnnber) connectLeader() (*libovsdb.OvsdbClient, error) {
+	n := len(ovnnber.remotes)
+	for i := 1; i <= n; i++ {
+		idx := (ovnnber.current + i) % n
+		r := ovnnber.remotes[idx]
+
+		client, err := connectRemote(r, ovnnber.ssl)
+		if err != nil {
+			log.Debugf("could not connect to OVN Northbound [ %s ]: %s", r, err)
+			continue
+		}
+
+		leader, err := isNBLeader(client)
+		if err != nil {
+			log.Debugf("could not get cluster status of OVN Northbound [ %s ]: %s", r, err)
+			client.Disconnect()
+			continue
+		}
+		if !leader {
+			log.Debugf("OVN Northbound [ %s ] is not the cluster leader", r)
+			client.Disconnect()
+			continue
+		}
+
+		ovnnber.current = idx
+		log.Infof("Connected to OVN Northbound [ %s ]", r)
+		return client, nil
+	}
+	return nil, fmt.Errorf("could not connect to the leader of OVN Northbound %v", ovnnber.remotes)
+}
+
+// failover replaces a lost or demoted northbound connection, retrying until
+// one of the remotes accepts it. from is the connection being replaced; if
+// it has been replaced already in the meantime there is nothing to do.
+func (ovnnber *ovnnber) failover(from *libovsdb.OvsdbClient) {
+	ovnnber.failoverMu.Lock()
+	defer ovnnber.failoverMu.Unlock()
+
+	if ovnnber.client() == from {
+		atomic.StoreInt32(&ovnnber.connected, 0)
+	}
+	for ovnnber.client() == from {
+		if err := ovnnber.reconnectLocked(); err != nil {
+			log.Errorf("OVN Northbound failover failed: %s. Retrying in %v", err, config.FailoverRetryInterval)
+			time.Sleep(config.FailoverRetryInterval.Duration)
+		}
+	}
+}
+
+// watchLeader periodically checks that the northbound connection is still
+// attached to the cluster leader and fails over when it is not
+func (ovnnber *ovnnber) watchLeader(done <-chan bool) {
+	ticker := time.NewTicker(config.LeaderCheckInterval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			log.Debugf("Quit watch leader goroutine")
+			return
+		case <-ticker.C:
+			client := ovnnber.client()
+			leader, err := isNBLeader(client)
+			if err == nil && leader {
+				continue
+			}
+			if err != nil {
+				log.Errorf("could not get OVN Northbound cluster status: %s", err)
+			} else {
+				log.Infof("OVN Northbound server lost the cluster leadership")
+			}
+			ovnnber.failover(client)
+		}
+	}
+}
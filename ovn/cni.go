@@ -0,0 +1,279 @@
+package ovn
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// CNI wires the containers of a CNI runtime, e.g. containerd or Kubernetes,
+// to OVN the way the driver wires the ones of Docker, without Docker
+type CNI struct {
+	d *Driver
+}
+
+// CNINetwork is what the plugin uses of a CNI network configuration
+type CNINetwork struct {
+	// Name of the CNI network, naming the logical switch unless Switch does
+	Name   string
+	Switch string
+	// Subnet is set as other_config:subnet of the switch when ovn-northd
+	// assigns the addresses
+	Subnet  string
+	Gateway string
+	MTU     int
+}
+
+// CNIEndpoint is the interface of a container on a CNI network
+type CNIEndpoint struct {
+	ContainerID string
+	Netns       string
+	IfName      string
+	// Address is the IPv4 CIDR the IPAM plugin chose, or empty to let
+	// ovn-northd assign it from the subnet of the switch
+	Address string
+	MAC     string
+}
+
+// CNIAttachment is what Add plugged for an endpoint
+type CNIAttachment struct {
+	HostInterface string
+	HostMAC       string
+	Interface     string
+	MAC           string
+	Address       string
+	Gateway       string
+	LogicalPort   string
+}
+
+// NewCNI connects to the OVN Northbound and the local Open_vSwitch as
+// NewDriver does
+func NewCNI(nbRemote, ovsdbRemote string, sslConfig *SSLConfig) (*CNI, error) {
+	d := &Driver{
+		networks:  make(map[string]*NetworkState),
+		endpoints: make(map[string]*EndpointState),
+	}
+	if err := d.connect(nbRemote, ovsdbRemote, sslConfig); err != nil {
+		return nil, err
+	}
+	return &CNI{d: d}, nil
+}
+
+// Close disconnects from the databases
+func (c *CNI) Close() {
+	if client := c.d.ovnnber.client(); client != nil {
+		client.Disconnect()
+	}
+	if c.d.ovsdber.ovsdb != nil {
+		c.d.ovsdber.ovsdb.Disconnect()
+	}
+}
+
+// cniID derives a stable id, in the form of the ids of Docker, from a name
+func cniID(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+func (nw *CNINetwork) switchName() string {
+	if nw.Switch != "" {
+		return nw.Switch
+	}
+	return config.BridgePrefix + nw.Name
+}
+
+// ids returns the network and endpoint ids the driver knows the endpoint by
+func (ep *CNIEndpoint) ids(nw *CNINetwork) (string, string) {
+	return cniID("cni/" + nw.Name), cniID(ep.ContainerID + "/" + ep.IfName)
+}
+
+// Add creates the logical switch if needed and the logical port of the
+// endpoint, plugs it into OVS as Join does and moves the container side of
+// the veth pair into the container's namespace with the address and routes
+func (c *CNI) Add(nw *CNINetwork, ep *CNIEndpoint) (*CNIAttachment, error) {
+	networkID, endpointID := ep.ids(nw)
+	r := newRequest("CNIAdd", networkID, endpointID)
+	switchName := nw.switchName()
+
+	ns := &NetworkState{
+		id:               networkID,
+		BridgeName:       switchName,
+		MTU:              nw.MTU,
+		Gateway:          nw.Gateway,
+		DynamicAddresses: ep.Address == "",
+		// the port is not waited for: there is no table monitor to see it up
+		JoinWait: joinWaitNone,
+	}
+	c.d.setNetwork(ns)
+
+	if err := c.d.ovnnber.addBridge(r, switchName, "", ""); err != nil {
+		return nil, err
+	}
+	if ns.DynamicAddresses {
+		if err := c.d.initDynamicAddresses(r, switchName, nw.Subnet, nw.Gateway); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := c.d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  networkID,
+		EndpointID: endpointID,
+		Interface:  &network.EndpointInterface{Address: ep.Address, MacAddress: ep.MAC},
+	})
+	if err != nil {
+		return nil, err
+	}
+	es, _ := c.d.endpoint(endpointID)
+	address := ep.Address
+	if res.Interface != nil && res.Interface.Address != "" {
+		address = res.Interface.Address
+	}
+
+	join, err := c.d.Join(&network.JoinRequest{
+		NetworkID:  networkID,
+		EndpointID: endpointID,
+		SandboxKey: ep.Netns,
+	})
+	if err != nil {
+		c.d.deleteEndpoint(r, switchName, es.LogicalPortName)
+		return nil, err
+	}
+
+	if err := setupContainerLink(r, join.InterfaceName.SrcName, ep.Netns, ep.IfName, address, nw.Gateway, nw.MTU); err != nil {
+		c.d.unplugVeth(r, es)
+		c.d.deleteEndpoint(r, switchName, es.LogicalPortName)
+		return nil, err
+	}
+
+	att := &CNIAttachment{
+		HostInterface: es.vethOut,
+		Interface:     ep.IfName,
+		MAC:           es.mac,
+		Address:       address,
+		Gateway:       nw.Gateway,
+		LogicalPort:   es.LogicalPortName,
+	}
+	if link, err := netlink.LinkByName(es.vethOut); err == nil {
+		att.HostMAC = link.Attrs().HardwareAddr.String()
+	}
+	r.log.Infof("Added container [ %s ] to logical switch [ %s ] through [ %s ]", ep.ContainerID, switchName, es.LogicalPortName)
+	return att, nil
+}
+
+// Del unplugs the endpoint and deletes its logical port. Missing pieces are
+// skipped, as CNI may call it more than once.
+func (c *CNI) Del(nw *CNINetwork, ep *CNIEndpoint) error {
+	networkID, endpointID := ep.ids(nw)
+	r := newRequest("CNIDel", networkID, endpointID)
+	es := &EndpointState{
+		LogicalPortName: getLogicalPortNamefromresource(networkID, endpointID),
+		vethOut:         endpointID[0:15],
+	}
+	c.d.unplugVeth(r, es)
+
+	exists, err := c.d.ovnnber.endpointpointExists(es.LogicalPortName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if err := c.d.deleteEndpoint(r, nw.switchName(), es.LogicalPortName); err != nil {
+			return err
+		}
+	}
+	r.log.Infof("Deleted container [ %s ] from logical switch [ %s ]", ep.ContainerID, nw.switchName())
+	return nil
+}
+
+// Check tells whether the logical port, the host veth and the interface in
+// the container's namespace of the endpoint are all there
+func (c *CNI) Check(nw *CNINetwork, ep *CNIEndpoint) error {
+	networkID, endpointID := ep.ids(nw)
+	logicalPortName := getLogicalPortNamefromresource(networkID, endpointID)
+	exists, err := c.d.ovnnber.endpointpointExists(logicalPortName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("logical port [ %s ] does not exist", logicalPortName)
+	}
+	if !nested() {
+		if _, err := netlink.LinkByName(endpointID[0:15]); err != nil {
+			return fmt.Errorf("veth [ %s ] does not exist: %s", endpointID[0:15], err)
+		}
+	}
+
+	nsh, err := netns.GetFromPath(ep.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %s : %s", ep.Netns, err.Error())
+	}
+	defer nsh.Close()
+	h, err := netlink.NewHandleAt(nsh)
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+	if _, err := h.LinkByName(ep.IfName); err != nil {
+		return fmt.Errorf("interface [ %s ] does not exist in %s: %s", ep.IfName, ep.Netns, err)
+	}
+	return nil
+}
+
+// setupContainerLink moves link into the namespace at netnsPath, renames it
+// to ifName and sets its MTU, address and default route through gateway
+func setupContainerLink(r *request, link, netnsPath, ifName, address, gateway string, mtu int) error {
+	nsh, err := netns.GetFromPath(netnsPath)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %s : %s", netnsPath, err.Error())
+	}
+	defer nsh.Close()
+
+	l, err := netlink.LinkByName(link)
+	if err != nil {
+		return fmt.Errorf("failed to get link by name %s : %s", link, err.Error())
+	}
+	err = netlink.LinkSetNsFd(l, int(nsh))
+	r.auditLink("move to "+netnsPath, link, err)
+	if err != nil {
+		return fmt.Errorf("failed to move %s to %s : %s", link, netnsPath, err.Error())
+	}
+
+	h, err := netlink.NewHandleAt(nsh)
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+
+	if l, err = h.LinkByName(link); err != nil {
+		return fmt.Errorf("failed to get link by name %s : %s", link, err.Error())
+	}
+	if err := h.LinkSetName(l, ifName); err != nil {
+		return fmt.Errorf("failed to rename %s to %s : %s", link, ifName, err.Error())
+	}
+	if mtu > 0 {
+		if err := h.LinkSetMTU(l, mtu); err != nil {
+			return fmt.Errorf("failed to set mtu of %s : %s", ifName, err.Error())
+		}
+	}
+	addr, err := netlink.ParseAddr(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %s : %s", address, err.Error())
+	}
+	if err := h.AddrAdd(l, addr); err != nil {
+		return fmt.Errorf("failed to add address %s to %s : %s", address, ifName, err.Error())
+	}
+	if err := h.LinkSetUp(l); err != nil {
+		return fmt.Errorf("failed to set link up %s", err.Error())
+	}
+	if gw := net.ParseIP(gateway); gw != nil {
+		if err := h.RouteAdd(&netlink.Route{LinkIndex: l.Attrs().Index, Gw: gw}); err != nil {
+			return fmt.Errorf("failed to add the default route through %s : %s", gateway, err.Error())
+		}
+	}
+	r.log.Debugf("Moved [ %s ] to [ %s ] as [ %s ] with [ %s ]", link, netnsPath, ifName, address)
+	return nil
+}
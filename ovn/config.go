@@ -0,0 +1,300 @@
+package ovn
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// EnvPrefix prefixes the environment variables overriding the config
+	EnvPrefix = "OVN_PLUGIN_"
+
+	// scopeGlobal needs a Docker cluster store; in scopeLocal every host
+	// creates the networks and they share the switches by network name
+	scopeGlobal = "global"
+	scopeLocal  = "local"
+
+	portSecurityNone  = "none"
+	portSecurityMAC   = "mac"
+	portSecurityMACIP = "mac-ip"
+
+	// interface names are limited to 15 characters and libnetwork appends
+	// the interface index to containerEthName
+	maxContainerEthName = 13
+)
+
+var (
+	validPortSecurity = map[string]bool{
+		portSecurityNone:  true,
+		portSecurityMAC:   true,
+		portSecurityMACIP: true,
+	}
+
+	// config is the plugin-wide configuration in use
+	config = DefaultConfig()
+)
+
+// Duration is a time.Duration read from strings such as "5s" in the config
+// file and the environment
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText parses a duration for TOML and the environment
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// UnmarshalYAML parses a duration for YAML
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.UnmarshalText([]byte(s))
+}
+
+// Config is the plugin-wide configuration. Every field can be set in the
+// config file under its yaml (or toml) key and overridden by the
+// environment variable EnvPrefix + its env name.
+type Config struct {
+	// DriverName is the network driver name the networks of the plugin
+	// carry in Docker: ovn, or the plugin reference when managed by Docker
+	DriverName string `yaml:"driver_name" toml:"driver_name" env:"DRIVER_NAME"`
+	// BridgePrefix prefixes the logical switch of a network that has no
+	// net.libnetwork.ovn.bridge.name option
+	BridgePrefix string `yaml:"bridge_prefix" toml:"bridge_prefix" env:"BRIDGE_PREFIX"`
+	// DefaultMTU of a network without the net.libnetwork.ovn.bridge.mtu option
+	DefaultMTU int `yaml:"default_mtu" toml:"default_mtu" env:"DEFAULT_MTU"`
+	// DefaultMode of a network without the net.libnetwork.ovn.bridge.mode option
+	DefaultMode string `yaml:"default_mode" toml:"default_mode" env:"DEFAULT_MODE"`
+	// ContainerEthName prefixes the interface names inside the containers
+	ContainerEthName string `yaml:"container_eth_name" toml:"container_eth_name" env:"CONTAINER_ETH_NAME"`
+	// DefaultRouter is the logical router new networks are attached to
+	// through their gateway IP; networks stay isolated when empty
+	DefaultRouter string `yaml:"default_router" toml:"default_router" env:"DEFAULT_ROUTER"`
+	// PortSecurity is the port security of the logical switch ports:
+	// none, mac or mac-ip
+	PortSecurity string `yaml:"port_security" toml:"port_security" env:"PORT_SECURITY"`
+
+	// ConnectRetries and ConnectRetryInterval bound the attempts to
+	// connect to OVSDB and the OVN Northbound at startup
+	ConnectRetries       int      `yaml:"connect_retries" toml:"connect_retries" env:"CONNECT_RETRIES"`
+	ConnectRetryInterval Duration `yaml:"connect_retry_interval" toml:"connect_retry_interval" env:"CONNECT_RETRY_INTERVAL"`
+	// LinkRetries and LinkRetryInterval bound the wait for a new netlink link
+	LinkRetries       int      `yaml:"link_retries" toml:"link_retries" env:"LINK_RETRIES"`
+	LinkRetryInterval Duration `yaml:"link_retry_interval" toml:"link_retry_interval" env:"LINK_RETRY_INTERVAL"`
+	// LeaderCheckInterval is how often the northbound connection is checked
+	// for having lost the cluster leadership
+	LeaderCheckInterval Duration `yaml:"leader_check_interval" toml:"leader_check_interval" env:"LEADER_CHECK_INTERVAL"`
+	// FailoverRetryInterval is the pause between two rounds over all
+	// northbound remotes when none of them could be reached
+	FailoverRetryInterval Duration `yaml:"failover_retry_interval" toml:"failover_retry_interval" env:"FAILOVER_RETRY_INTERVAL"`
+	// DynamicAddressTimeout bounds the wait for ovn-northd to assign the
+	// addresses of an endpoint on a network with dynamic addresses
+	DynamicAddressTimeout Duration `yaml:"dynamic_address_timeout" toml:"dynamic_address_timeout" env:"DYNAMIC_ADDRESS_TIMEOUT"`
+	// JoinWait is what Join waits for on networks without the
+	// net.libnetwork.ovn.join.wait option: none, up or binding
+	JoinWait string `yaml:"join_wait" toml:"join_wait" env:"JOIN_WAIT"`
+	// JoinWaitTimeout bounds that wait on networks without the
+	// net.libnetwork.ovn.join.wait_timeout option
+	JoinWaitTimeout Duration `yaml:"join_wait_timeout" toml:"join_wait_timeout" env:"JOIN_WAIT_TIMEOUT"`
+	// PhysicalNetwork is the physical network of flat networks without the
+	// net.libnetwork.ovn.physical_network option
+	PhysicalNetwork string `yaml:"physical_network" toml:"physical_network" env:"PHYSICAL_NETWORK"`
+	// NestedParentPort, when set, is the OVN logical port of the VM the
+	// plugin runs in: the container ports are its children and reach it
+	// through VLAN subinterfaces of NestedInterface, the VM's NIC
+	NestedParentPort string `yaml:"nested_parent_port" toml:"nested_parent_port" env:"NESTED_PARENT_PORT"`
+	NestedInterface  string `yaml:"nested_interface" toml:"nested_interface" env:"NESTED_INTERFACE"`
+	// Scope of the networks: global, with a Docker cluster store, or local,
+	// where each host creates the networks and joins their switches by name
+	Scope string `yaml:"scope" toml:"scope" env:"SCOPE"`
+}
+
+// DefaultConfig returns the configuration used when none is given
+func DefaultConfig() *Config {
+	return &Config{
+		DriverName:            DriverName,
+		BridgePrefix:          "ovnbr-",
+		DefaultMTU:            1500,
+		DefaultMode:           modeNAT,
+		ContainerEthName:      "eth",
+		PortSecurity:          portSecurityNone,
+		ConnectRetries:        3,
+		ConnectRetryInterval:  Duration{5 * time.Second},
+		LinkRetries:           2,
+		LinkRetryInterval:     Duration{2 * time.Second},
+		LeaderCheckInterval:   Duration{5 * time.Second},
+		FailoverRetryInterval: Duration{2 * time.Second},
+		DynamicAddressTimeout: Duration{10 * time.Second},
+		JoinWait:              joinWaitNone,
+		JoinWaitTimeout:       Duration{10 * time.Second},
+		PhysicalNetwork:       "physnet",
+		NestedInterface:       "eth0",
+		Scope:                 scopeGlobal,
+	}
+}
+
+// LoadConfig returns the default configuration overridden by the config
+// file at path, if any, and then by the environment. Files ending in .toml
+// are read as TOML, anything else as YAML.
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read config file [ %s ]: %s", path, err)
+		}
+		if strings.ToLower(filepath.Ext(path)) == ".toml" {
+			md, err := toml.Decode(string(data), c)
+			if err != nil {
+				return nil, fmt.Errorf("invalid config file [ %s ]: %s", path, err)
+			}
+			if undecoded := md.Undecoded(); len(undecoded) > 0 {
+				return nil, fmt.Errorf("invalid config file [ %s ]: unknown keys %v", path, undecoded)
+			}
+		} else if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, fmt.Errorf("invalid config file [ %s ]: %s", path, err)
+		}
+	}
+	if err := c.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// EnvSetting is a setting that can be given in the environment
+type EnvSetting struct {
+	Name    string // environment variable
+	Key     string // config file key
+	Default string
+}
+
+// EnvSettings lists the environment variables overriding the config file
+// with the default value of each setting
+func EnvSettings() []EnvSetting {
+	var settings []EnvSetting
+	v := reflect.ValueOf(DefaultConfig()).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		settings = append(settings, EnvSetting{
+			Name:    EnvPrefix + t.Field(i).Tag.Get("env"),
+			Key:     t.Field(i).Tag.Get("yaml"),
+			Default: fmt.Sprint(v.Field(i).Interface()),
+		})
+	}
+	return settings
+}
+
+// applyEnv overrides every field whose environment variable is set and
+// not empty
+func (c *Config) applyEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := EnvPrefix + t.Field(i).Tag.Get("env")
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		field := v.Field(i)
+		switch p := field.Addr().Interface().(type) {
+		case *string:
+			*p = value
+		case *int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s [ %s ]: not an integer", name, value)
+			}
+			*p = n
+		case *Duration:
+			if err := p.UnmarshalText([]byte(value)); err != nil {
+				return fmt.Errorf("invalid %s [ %s ]: %s", name, value, err)
+			}
+		default:
+			return fmt.Errorf("unsupported type of %s", name)
+		}
+	}
+	return nil
+}
+
+// Validate checks that the configuration is usable
+func (c *Config) Validate() error {
+	if c.DriverName == "" {
+		return fmt.Errorf("driver_name must not be empty")
+	}
+	if c.BridgePrefix == "" {
+		return fmt.Errorf("bridge_prefix must not be empty")
+	}
+	if c.DefaultMTU < 68 || c.DefaultMTU > 65535 {
+		return fmt.Errorf("default_mtu [ %d ] must be between 68 and 65535", c.DefaultMTU)
+	}
+	if !validModes[c.DefaultMode] {
+		return fmt.Errorf("default_mode [ %s ] must be one of %s or %s", c.DefaultMode, modeNAT, modeFlat)
+	}
+	if c.ContainerEthName == "" || len(c.ContainerEthName) > maxContainerEthName {
+		return fmt.Errorf("container_eth_name [ %s ] must have 1 to %d characters", c.ContainerEthName, maxContainerEthName)
+	}
+	if !validPortSecurity[c.PortSecurity] {
+		return fmt.Errorf("port_security [ %s ] must be one of %s, %s or %s", c.PortSecurity, portSecurityNone, portSecurityMAC, portSecurityMACIP)
+	}
+	if !validJoinWaits[c.JoinWait] {
+		return fmt.Errorf("join_wait [ %s ] must be one of %s, %s or %s", c.JoinWait, joinWaitNone, joinWaitUp, joinWaitBinding)
+	}
+	if c.PhysicalNetwork == "" {
+		return fmt.Errorf("physical_network must not be empty")
+	}
+	if c.NestedParentPort != "" && c.NestedInterface == "" {
+		return fmt.Errorf("nested_interface must not be empty with nested_parent_port")
+	}
+	if c.Scope != scopeGlobal && c.Scope != scopeLocal {
+		return fmt.Errorf("scope [ %s ] must be %s or %s", c.Scope, scopeGlobal, scopeLocal)
+	}
+	if c.ConnectRetries < 1 {
+		return fmt.Errorf("connect_retries [ %d ] must be at least 1", c.ConnectRetries)
+	}
+	if c.LinkRetries < 1 {
+		return fmt.Errorf("link_retries [ %d ] must be at least 1", c.LinkRetries)
+	}
+	for name, d := range map[string]Duration{
+		"connect_retry_interval":  c.ConnectRetryInterval,
+		"link_retry_interval":     c.LinkRetryInterval,
+		"leader_check_interval":   c.LeaderCheckInterval,
+		"failover_retry_interval": c.FailoverRetryInterval,
+		"dynamic_address_timeout": c.DynamicAddressTimeout,
+		"join_wait_timeout":       c.JoinWaitTimeout,
+	} {
+		if d.Duration <= 0 {
+			return fmt.Errorf("%s [ %s ] must be positive", name, d)
+		}
+	}
+	return nil
+}
+
+// SetConfig makes c the plugin-wide configuration. It must be called
+// before NewDriver.
+func SetConfig(c *Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	config = c
+	return nil
+}
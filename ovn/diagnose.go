@@ -0,0 +1,145 @@
+package ovn
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Check is the result of one check of the data path of an endpoint, with a
+// hint to fix it when it failed
+type Check struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	// Skipped is set when the check could not run, e.g. without southbound
+	Skipped bool   `json:"skipped,omitempty"`
+	Detail  string `json:"detail"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+// Diagnosis is the endpoint of a container and the checks of every hop of
+// its data path
+type Diagnosis struct {
+	Endpoint *EndpointView `json:"endpoint"`
+	Checks   []Check       `json:"checks"`
+}
+
+// Passed tells whether no check failed
+func (d *Diagnosis) Passed() bool {
+	for _, c := range d.Checks {
+		if !c.Passed && !c.Skipped {
+			return false
+		}
+	}
+	return true
+}
+
+// Diagnose checks the data path of the endpoint Endpoint returns, from the
+// northbound logical switch down to the veth of the container
+func (i *Inspector) Diagnose(nameOrID, network string) (*Diagnosis, error) {
+	nw, ep, err := i.lookupEndpoint(nameOrID, network)
+	if err != nil {
+		return nil, err
+	}
+	d := &Diagnosis{Endpoint: ep}
+	add := func(name string, passed bool, detail, hint string) {
+		c := Check{Name: name, Passed: passed, Detail: detail}
+		if !passed {
+			c.Hint = hint
+		}
+		d.Checks = append(d.Checks, c)
+	}
+	skip := func(name, detail string) {
+		d.Checks = append(d.Checks, Check{Name: name, Skipped: true, Detail: detail})
+	}
+
+	add("logical switch", nw.SwitchFound,
+		fmt.Sprintf("Logical_Switch [ %s ] of network [ %s ]", nw.LogicalSwitch, nw.Name),
+		"the network was created while the northbound was unreachable or the switch was deleted; recreate the network")
+
+	add("logical port", ep.PortFound,
+		fmt.Sprintf("Logical_Switch_Port [ %s ]", ep.LogicalPort),
+		"the endpoint was created while the northbound was unreachable or the port was deleted; reconnect the container to the network")
+
+	if ep.PortFound {
+		ip := strings.Split(ep.IP, "/")[0]
+		addressed := hasAddress(ep.DynamicAddresses, ep.MAC, ip)
+		for _, addr := range ep.Addresses {
+			if hasAddress(addr, ep.MAC, ip) {
+				addressed = true
+			}
+		}
+		add("port addresses", addressed,
+			fmt.Sprintf("addresses %v, docker has [ %s %s ]", ep.Addresses, ep.MAC, ip),
+			"set them with ovn-nbctl lsp-set-addresses "+ep.LogicalPort+" \""+ep.MAC+" "+ip+"\"")
+
+		add("port up", ep.Up,
+			fmt.Sprintf("up is [ %t ]", ep.Up),
+			"ovn-controller has not claimed the port; check that it runs on the host of the container and that the OVS interface below exists")
+	} else {
+		skip("port addresses", "no logical port")
+		skip("port up", "no logical port")
+	}
+
+	add("OVS interface", ep.Interface != "",
+		fmt.Sprintf("Interface with external_ids:iface-id=%s [ %s ]", ep.LogicalPort, ep.Interface),
+		"the veth was not added to the integration bridge; restart the container or add it with ovs-vsctl add-port BRIDGE "+ep.Veth+" -- set Interface "+ep.Veth+" external_ids:iface-id="+ep.LogicalPort)
+
+	if ep.Interface != "" {
+		detail := fmt.Sprintf("ofport [ %d ], link_state [ %s ]", ep.OFPort, ep.LinkState)
+		if ep.IfaceError != "" {
+			detail += ", error [ " + ep.IfaceError + " ]"
+		}
+		add("OVS ofport", ep.OFPort > 0 && ep.IfaceError == "", detail,
+			"OVS could not open the interface; check that the veth exists in the host namespace")
+	} else {
+		skip("OVS ofport", "no OVS interface")
+	}
+
+	add("veth", ep.VethState != "missing",
+		fmt.Sprintf("host veth [ %s ] is %s", ep.Veth, ep.VethState),
+		"the veth pair is gone; restart the container")
+
+	if ep.VethState != "missing" {
+		add("veth up", ep.VethUp,
+			fmt.Sprintf("host veth [ %s ] admin up [ %t ]", ep.Veth, ep.VethUp),
+			"bring it up with ip link set "+ep.Veth+" up")
+	} else {
+		skip("veth up", "no veth")
+	}
+
+	if !i.HasSouthbound() {
+		skip("port binding", "no southbound remote, give --sb-remote or set external_ids:ovn-remote")
+	} else {
+		add("port binding", ep.BindingFound,
+			fmt.Sprintf("Port_Binding [ %s ]", ep.LogicalPort),
+			"ovn-northd has not translated the logical port; check that ovn-northd runs and is connected to both databases")
+
+		if ep.BindingFound {
+			local := ep.Chassis != "" && ep.Chassis == i.SystemID
+			detail := fmt.Sprintf("bound to chassis [ %s ], this host is [ %s ]", ep.Chassis, i.SystemID)
+			hint := "ovn-controller of this host has not bound the port; check ovn-controller and external_ids:ovn-remote and ovn-encap-ip of the local Open_vSwitch"
+			if ep.Chassis != "" && !local {
+				hint = "another chassis claims the port; check that no other host uses the same iface-id"
+			}
+			add("chassis", local, detail, hint)
+		} else {
+			skip("chassis", "no port binding")
+		}
+	}
+	return d, nil
+}
+
+// hasAddress tells whether addr, a "MAC IP..." entry of the addresses or the
+// dynamic_addresses of a logical port, is the MAC and the IP
+func hasAddress(addr, mac, ip string) bool {
+	fields := strings.Fields(addr)
+	if len(fields) < 2 || ip == "" || !strings.EqualFold(fields[0], mac) {
+		return false
+	}
+	for _, f := range fields[1:] {
+		if f == ip {
+			return true
+		}
+	}
+	return false
+}
@@ -19,21 +19,26 @@ const (
 	DriverName = "ovn"
 	// Localhost is the default ovsdb host
 	Localhost = "127.0.0.1"
+	// DefaultNBRemote is the default OVN Northbound remote
+	DefaultNBRemote = "tcp:127.0.0.1:6641"
 
-	bridgePrefix        = "ovnbr-"
-	ovnbridge           = "br-int"
-	containerEthName    = "eth"
 	bridgeNameOption    = "net.libnetwork.ovn.bridge.name"
 	bindInterfaceOption = "net.libnetwork.ovn.bridge.bind_interface"
 
 	mtuOption  = "net.libnetwork.ovn.bridge.mtu"
 	modeOption = "net.libnetwork.ovn.bridge.mode"
 
+	// addressesOption set to dynamic lets ovn-northd assign the addresses
+	// of the endpoints from other_config:subnet of the logical switch,
+	// which subnetOption sets
+	addressesOption = "net.libnetwork.ovn.addresses"
+	subnetOption    = "net.libnetwork.ovn.subnet"
+
 	modeNAT  = "nat"
 	modeFlat = "flat"
 
-	defaultMTU  = 1500
-	defaultMode = modeNAT
+	addressesStatic  = "static"
+	addressesDynamic = "dynamic"
 )
 
 var (
@@ -41,6 +46,11 @@ var (
 		modeNAT:  true,
 		modeFlat: true,
 	}
+
+	validAddresses = map[string]bool{
+		addressesStatic:  true,
+		addressesDynamic: true,
+	}
 )
 
 type dockerer struct {
@@ -51,9 +61,11 @@ type dockerer struct {
 type Driver struct {
 	ovnnber
 	ovsdber
+	sbber
 	dockerer
-	netmu     sync.Mutex // guides networks map
+	netmu     sync.RWMutex // guards networks map
 	networks  map[string]*NetworkState
+	epmu      sync.RWMutex // guards endpoints map
 	endpoints map[string]*EndpointState
 }
 
@@ -67,6 +79,27 @@ type NetworkState struct {
 	Gateway           string
 	GatewayMask       string
 	FlatBindInterface string
+	// DynamicAddresses is set when ovn-northd assigns the endpoint addresses
+	DynamicAddresses bool
+	// JoinWait is what Join waits for, at most JoinWaitTimeout
+	JoinWait        string
+	JoinWaitTimeout time.Duration
+	// Tenant owns the network, which is only routed to the networks of the
+	// same tenant
+	Tenant string
+	// PhysicalNetwork and VLAN, 0 when untagged, of a flat network
+	PhysicalNetwork string
+	VLAN            int
+	// remote is set when the table monitor learned the network from the
+	// OVN Northbound, as another host created it
+	remote bool
+	// Name of the network in Docker, by which the hosts share its switch in
+	// local scope
+	Name string
+	// pending is set in local scope until the first endpoint gives the
+	// network its switch
+	pending bool
+	subnet  string // other_config:subnet given for dynamic addresses
 }
 
 // EndpointState is filled in at network creation time
@@ -77,15 +110,62 @@ type EndpointState struct {
 	mac             string
 	vethOut         string
 	vethIn          string
+	networkID       string
+	sandboxKey      string // set while joined, guarded by epmu
+	floatingIP      string // given by the endpoint option, set up on Join
 }
 
 type ovnnber struct {
-	ovsdb  *libovsdb.OvsdbClient
-	driver *Driver
+	mu         sync.RWMutex // guards ovsdb across reconnects
+	ovsdb      *libovsdb.OvsdbClient
+	remotes    []remote
+	current    int        // index of the remote ovsdb is connected to
+	failoverMu sync.Mutex // serializes reconnects
+	connected  int32      // 1 while ovsdb is up, accessed atomically
+	monitoring int32      // 1 while the table monitor runs, accessed atomically
+	ssl        *SSLConfig
+	driver     *Driver
 }
 
 type ovsdber struct {
-	ovsdb *libovsdb.OvsdbClient
+	ovsdb  *libovsdb.OvsdbClient
+	bridge string // OVN integration bridge
+}
+
+// network returns the state of a network. The table monitor replaces the
+// states of the networks of other hosts, so it is read under netmu.
+func (d *Driver) network(id string) (*NetworkState, bool) {
+	d.netmu.RLock()
+	defer d.netmu.RUnlock()
+	ns, ok := d.networks[id]
+	return ns, ok
+}
+
+func (d *Driver) setNetwork(ns *NetworkState) {
+	d.netmu.Lock()
+	defer d.netmu.Unlock()
+	d.networks[ns.id] = ns
+}
+
+// endpoint returns the state of an endpoint, read under epmu as the
+// requests of Docker come concurrently
+func (d *Driver) endpoint(id string) (*EndpointState, bool) {
+	d.epmu.RLock()
+	defer d.epmu.RUnlock()
+	ep, ok := d.endpoints[id]
+	return ep, ok
+}
+
+func (d *Driver) setEndpoint(id string, ep *EndpointState) {
+	d.epmu.Lock()
+	defer d.epmu.Unlock()
+	d.endpoints[id] = ep
+}
+
+func (d *Driver) forgetEndpoint(id string) {
+	d.epmu.Lock()
+	defer d.epmu.Unlock()
+	delete(d.endpoints, id)
 }
 
 // Enable a netlink interface
@@ -103,7 +183,7 @@ func truncateID(id string) string {
 }
 
 func getBridgeName(r *network.CreateNetworkRequest) (string, error) {
-	bridgeName := bridgePrefix + truncateID(r.NetworkID)
+	bridgeName := config.BridgePrefix + truncateID(r.NetworkID)
 	if r.Options != nil {
 		if name, ok := r.Options[bridgeNameOption].(string); ok {
 			bridgeName = name
@@ -118,7 +198,7 @@ func getLogicalPortName(req *network.CreateEndpointRequest) string {
 }
 
 func getBridgeMTU(r *network.CreateNetworkRequest) (int, error) {
-	bridgeMTU := defaultMTU
+	bridgeMTU := config.DefaultMTU
 	if r.Options != nil {
 		if mtu, ok := r.Options[mtuOption].(int); ok {
 			bridgeMTU = mtu
@@ -128,7 +208,7 @@ func getBridgeMTU(r *network.CreateNetworkRequest) (int, error) {
 }
 
 func getBridgeMode(r *network.CreateNetworkRequest) (string, error) {
-	bridgeMode := defaultMode
+	bridgeMode := config.DefaultMode
 	if r.Options != nil {
 		if mode, ok := r.Options[modeOption].(string); ok {
 			if _, isValid := validModes[mode]; !isValid {
@@ -193,7 +273,7 @@ func getLogicalPortNamefromresource(nid, eid string) string {
 }
 
 func getBridgeNamefromresource(r *dockerclient.NetworkResource) (string, error) {
-	bridgeName := bridgePrefix + truncateID(r.ID)
+	bridgeName := config.BridgePrefix + truncateID(r.ID)
 	if r.Options != nil {
 		if name, ok := r.Options[bridgeNameOption]; ok {
 			bridgeName = name
@@ -228,58 +308,30 @@ func getInterfaceInfo(req *network.CreateEndpointRequest) (ipaddr, mac string, e
 	return ipaddr, mac, nil
 }
 
-// NewDriver creates an OVN driver
-func NewDriver(nbip string) (*Driver, error) {
+// NewDriver creates an OVN driver. nbRemote is a comma-separated list of OVN
+// Northbound remotes in OVN syntax (ssl:host:port, tcp:host:port or
+// unix:/path), e.g. the members of a clustered database; when empty it is
+// read from external_ids:ovn-nb of the local Open_vSwitch table.
+// ovsdbRemote is the local Open_vSwitch database remote in the same syntax.
+// sslConfig is only needed for ssl remotes.
+func NewDriver(nbRemote, ovsdbRemote string, sslConfig *SSLConfig) (*Driver, error) {
 	docker, err := dockerclient.NewDockerClient("unix:///var/run/docker.sock", nil)
 	if err != nil {
 		return nil, fmt.Errorf("could not connect to docker: %s", err)
 	}
 
-	// initiate the ovn-nb manager port binding
-	var ovnnb *libovsdb.OvsdbClient
-	retries := 3
-	for i := 0; i < retries; i++ {
-		ovnnb, err = libovsdb.Connect(nbip, ovnNBPort)
-		if err == nil {
-			break
-		}
-		log.Errorf("could not connect to OVN Northbound on port [ %d ]: %s. Retrying in 5 seconds", ovnNBPort, err)
-		time.Sleep(5 * time.Second)
-	}
-
-	if ovnnb == nil {
-		return nil, fmt.Errorf("could not connect to OVN Northbound")
-	}
-
-	// initiate the ovsdb manager port binding
-	var ovsdb *libovsdb.OvsdbClient
-	retries = 3
-	for i := 0; i < retries; i++ {
-		ovsdb, err = libovsdb.Connect(Localhost, ovsdbPort)
-		if err == nil {
-			break
-		}
-		log.Errorf("could not connect to OVSDB on port [ %d ]: %s. Retrying in 5 seconds", ovsdbPort, err)
-		time.Sleep(5 * time.Second)
-	}
-
-	if ovsdb == nil {
-		return nil, fmt.Errorf("could not connect to OVSDB")
-	}
-
 	d := &Driver{
 		dockerer: dockerer{
 			client: docker,
 		},
-		ovnnber: ovnnber{
-			ovsdb: ovnnb,
-		},
-		ovsdber: ovsdber{
-			ovsdb: ovsdb,
-		},
 		networks:  make(map[string]*NetworkState),
 		endpoints: make(map[string]*EndpointState),
 	}
+
+	if err := d.connect(nbRemote, ovsdbRemote, sslConfig); err != nil {
+		return nil, err
+	}
+
 	//recover networks and endpoints
 	netlist, err := d.dockerer.client.ListNetworks("")
 	if err != nil {
@@ -288,7 +340,7 @@ func NewDriver(nbip string) (*Driver, error) {
 	d.ovnnber.driver = d
 
 	for _, net := range netlist {
-		if net.Driver == DriverName {
+		if net.Driver == config.DriverName {
 			netInspect, err := d.dockerer.client.InspectNetwork(net.ID)
 			if err != nil {
 				return nil, fmt.Errorf("could not inpect docker networks inpect: %s", err)
@@ -297,38 +349,138 @@ func NewDriver(nbip string) (*Driver, error) {
 			if err != nil {
 				return nil, err
 			}
-			ns := &NetworkState{
-				id:         net.ID,
-				BridgeName: bridgeName,
+			// the switch of a pool of the OVN IPAM driver is named after the pool
+			if poolSwitch, err := d.ovnnber.networkSwitch(net.ID); err == nil && poolSwitch != "" {
+				bridgeName = poolSwitch
+			}
+			// in local scope the switch may be the one of the network of the
+			// same name on another host, or not exist before an endpoint
+			pending := false
+			if config.Scope == scopeLocal {
+				namedSwitch, err := d.ovnnber.namedSwitch(netInspect.Name)
+				if err != nil {
+					return nil, err
+				}
+				if namedSwitch != "" {
+					bridgeName = namedSwitch
+				} else if exists, err := d.ovnnber.bridgeExists(bridgeName); err == nil && !exists {
+					pending = true
+				}
+			}
+			// the switch records the whole state, but for networks created
+			// by an older plugin, which Docker's options have to do for
+			ns, err := d.ovnnber.loadNetworkState(net.ID, bridgeName)
+			if err != nil {
+				return nil, err
+			}
+			if ns == nil {
+				ns = networkStateFromResource(netInspect, bridgeName)
 			}
-			d.netmu.Lock()
-			d.netmu.Unlock()
-			d.networks[net.ID] = ns
+			ns.pending = pending
+			d.setNetwork(ns)
 			log.Debugf("exist network create by this driver:%v", netInspect.Name)
 
 			for c, ep := range netInspect.Containers {
 				log.Debugf("Container name: %v eid %v", c, ep)
 				logicalPortName := getLogicalPortNamefromresource(net.ID, ep.EndpointID)
+				// the endpoints Docker lists are joined, and the tenant
+				// check of the next Join of their container needs its sandbox
+				info, err := d.dockerer.client.InspectContainer(c)
+				if err != nil {
+					return nil, fmt.Errorf("could not inspect docker container [ %s ]: %s", c, err)
+				}
 				es := &EndpointState{
 					LogicalPortName: logicalPortName,
 					addr:            ep.IPv4Address,
 					mac:             ep.MacAddress,
 					vethOut:         ep.EndpointID[0:15],
+					networkID:       net.ID,
+					sandboxKey:      info.NetworkSettings.SandboxKey,
 				}
-				d.endpoints[ep.EndpointID] = es
-				log.Debugf("exist endpoint: %v", d.endpoints[ep.EndpointID])
+				d.setEndpoint(ep.EndpointID, es)
+				log.Debugf("exist endpoint: %v", es)
 			}
 		}
 	}
 
-	d.ovnnber.initDBCache()
-
-	// fixmehk: add the following setup
-	// ovs_vsctl("set", "open_vswitch", ".",
-	//	"external_ids:ovn-bridge=" + OVN_BRIDGE); OVN_BRIDGE=br-int
+	if err := d.ovnnber.initDBCache(); err != nil {
+		return nil, err
+	}
 	return d, nil
 }
 
+// connect connects to the local Open_vSwitch database, but in nested mode,
+// and to the OVN Northbound, as NewDriver describes the remotes
+func (d *Driver) connect(nbRemote, ovsdbRemote string, sslConfig *SSLConfig) error {
+	if ovsdbRemote == "" {
+		ovsdbRemote = DefaultOvsdbRemote
+	}
+	ovsdbr, err := parseRemote(ovsdbRemote, ovsdbPort)
+	if err != nil {
+		return err
+	}
+
+	if nested() {
+		// a VM in nested mode has no local OVS to read the remote from
+		if nbRemote == "" {
+			return fmt.Errorf("nested mode needs the OVN Northbound remote")
+		}
+		log.Infof("Nested in logical port [ %s ] through [ %s ]", config.NestedParentPort, config.NestedInterface)
+	} else {
+		// initiate the ovsdb manager port binding
+		d.ovsdber.ovsdb, err = connectWithRetry("OVSDB", func() (*libovsdb.OvsdbClient, error) {
+			return connectRemote(ovsdbr, sslConfig)
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := d.ovsdber.initIntegrationBridge(newRequest("NewDriver", "", "")); err != nil {
+			return err
+		}
+	}
+
+	if nbRemote == "" {
+		nbRemote, err = d.ovsdber.getNBRemote()
+		if err != nil {
+			return fmt.Errorf("could not read external_ids:ovn-nb from OVSDB: %s", err)
+		}
+		if nbRemote == "" {
+			nbRemote = DefaultNBRemote
+		}
+		log.Infof("Using OVN Northbound remote [ %s ] from the local Open_vSwitch", nbRemote)
+	}
+
+	nbRemotes, err := parseRemotes(nbRemote, ovnNBPort)
+	if err != nil {
+		return err
+	}
+	d.ovnnber.remotes = nbRemotes
+	d.ovnnber.current = -1
+	d.ovnnber.ssl = sslConfig
+
+	// initiate the ovn-nb manager port binding
+	d.ovnnber.ovsdb, err = connectWithRetry("OVN Northbound", d.ovnnber.connectLeader)
+	if err != nil {
+		return err
+	}
+	d.ovnnber.connected = 1
+	return nil
+}
+
+// connectWithRetry calls connect a few times before giving up
+func connectWithRetry(name string, connect func() (*libovsdb.OvsdbClient, error)) (*libovsdb.OvsdbClient, error) {
+	for i := 0; i < config.ConnectRetries; i++ {
+		client, err := connect()
+		if err == nil {
+			return client, nil
+		}
+		log.Errorf("could not connect to %s: %s. Retrying in %v", name, err, config.ConnectRetryInterval)
+		time.Sleep(config.ConnectRetryInterval.Duration)
+	}
+	return nil, fmt.Errorf("could not connect to %s", name)
+}
+
 // AllocateNetwork allows a network
 func (d *Driver) AllocateNetwork(req *network.AllocateNetworkRequest) (*network.AllocateNetworkResponse, error) {
 	log.Debugf("Allocate network request: %+v", req)
@@ -340,22 +492,42 @@ func (d *Driver) AllocateNetwork(req *network.AllocateNetworkRequest) (*network.
 
 // CreateEndpoint creates an logical switch port
 func (d *Driver) CreateEndpoint(req *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
-	log.Infof("Create endpoint request: %+v", req)
+	r := newRequest("CreateEndpoint", req.NetworkID, req.EndpointID)
+	r.log.Infof("Create endpoint request: %+v", req)
 
-	if _, ok := d.networks[req.NetworkID]; !ok {
+	ns, ok := d.network(req.NetworkID)
+	if !ok {
 		return nil, fmt.Errorf("failed to find logical switch for network id [ %s ]", req.NetworkID)
 	}
-	bridgeName := d.networks[req.NetworkID].BridgeName
-	log.Debugf("Bridge name: [ %s ]", bridgeName)
+	ns, err := d.resolveNetwork(r, ns)
+	if err != nil {
+		return nil, err
+	}
+	bridgeName := ns.BridgeName
+	r.log.Debugf("Bridge name: [ %s ]", bridgeName)
 
 	logicalPortName := getLogicalPortName(req)
-	log.Debugf("LogicalPort name: [ %s ]", logicalPortName)
+	r.log.Debugf("LogicalPort name: [ %s ]", logicalPortName)
+
+	floatingIP, err := getFloatingIP(req)
+	if err != nil {
+		return nil, err
+	}
+	if floatingIP != "" {
+		if err := d.ovnnber.checkFloatingIP(floatingIP, logicalPortName); err != nil {
+			return nil, err
+		}
+	}
+
+	if ns.DynamicAddresses && (req.Interface == nil || req.Interface.Address == "") {
+		return d.createDynamicEndpoint(r, req, bridgeName, logicalPortName, floatingIP)
+	}
 
 	ipaddr, macaddr, err := getInterfaceInfo(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get interface [ %s ]", req.EndpointID)
 	}
-	log.Debugf("Interface addr [ %s ] mac [ %s ]", ipaddr, macaddr)
+	r.log.Debugf("Interface addr [ %s ] mac [ %s ]", ipaddr, macaddr)
 
 	// 1. Create logical port in NB
 	// 1.1 ovn_nbctl("lsp-add", nid, eid)
@@ -364,44 +536,72 @@ func (d *Driver) CreateEndpoint(req *network.CreateEndpointRequest) (*network.Cr
 		LogicalPortName: logicalPortName,
 		addr:            ipaddr,
 		mac:             macaddr,
+		networkID:       req.NetworkID,
+		floatingIP:      floatingIP,
 	}
-	d.endpoints[req.EndpointID] = es
+	d.setEndpoint(req.EndpointID, es)
 
-	if err := d.createEndpoint(bridgeName, logicalPortName); err != nil {
-		delete(d.endpoints, req.EndpointID)
-		return nil, fmt.Errorf("ovn failed to create endpoint")
+	// an address of the OVN IPAM driver comes with its reserved port
+	claimed, err := d.ovnnber.claimAddress(r, bridgeName, ipaddr, logicalPortName)
+	if err != nil {
+		d.forgetEndpoint(req.EndpointID)
+		return nil, fmt.Errorf("ovn failed to claim address [ %s ]", ipaddr)
+	}
+	if !claimed {
+		if err := d.createEndpoint(r, bridgeName, logicalPortName); err != nil {
+			d.forgetEndpoint(req.EndpointID)
+			return nil, fmt.Errorf("ovn failed to create endpoint")
+		}
+	} else if nested() {
+		if err := d.ovnnber.nestLogicalPort(r, logicalPortName); err != nil {
+			d.forgetEndpoint(req.EndpointID)
+			return nil, err
+		}
 	}
 
-	if err := d.setEndpointAddr(logicalPortName, ipaddr, macaddr); err != nil {
+	if err := d.setEndpointAddr(r, logicalPortName, ipaddr, macaddr); err != nil {
 		return nil, fmt.Errorf("ovn failed to set endpoint addr")
 	}
+	if err := d.ovnnber.tagTenant(r, "Logical_Switch_Port", logicalPortName, ns.Tenant); err != nil {
+		d.deleteEndpoint(r, bridgeName, logicalPortName)
+		d.forgetEndpoint(req.EndpointID)
+		return nil, err
+	}
 
 	res := &network.CreateEndpointResponse{
 		Interface: &network.EndpointInterface{
 			MacAddress: macaddr,
 		},
 	}
-	log.Infof("Created logical port [ %s ] for endpoint id [ %v ]", es.LogicalPortName, req.EndpointID)
+	r.log.Infof("Created logical port [ %s ] for endpoint id [ %v ]", es.LogicalPortName, req.EndpointID)
 	return res, nil
 }
 
 // DeleteEndpoint deletes a logical switch port
 func (d *Driver) DeleteEndpoint(req *network.DeleteEndpointRequest) error {
-	log.Infof("Delete endpoint request: %+v", req)
+	r := newRequest("DeleteEndpoint", req.NetworkID, req.EndpointID)
+	r.log.Infof("Delete endpoint request: %+v", req)
 
-	if _, ok := d.networks[req.NetworkID]; !ok {
+	ns, ok := d.network(req.NetworkID)
+	if !ok {
 		return fmt.Errorf("failed to find logical switch for network id [ %s ]", req.NetworkID)
 	}
-	bridgeName := d.networks[req.NetworkID].BridgeName
+	bridgeName := ns.BridgeName
 	log.Infof("Bridge name: %s", bridgeName)
 
-	if _, ok := d.endpoints[req.EndpointID]; !ok {
+	ep, ok := d.endpoint(req.EndpointID)
+	if !ok {
 		return fmt.Errorf("failed to find endpoint for id [ %s ]", req.NetworkID)
 	}
-	endpointName := d.endpoints[req.EndpointID].LogicalPortName
-	log.Infof("Endpoint name: %s", endpointName)
+	endpointName := ep.LogicalPortName
+	r.log.Infof("Endpoint name: %s", endpointName)
+
+	// the floating IP is left behind when Leave did not run
+	if err := d.ovnnber.deleteFloatingIP(r, networkRouter(ns.Tenant), endpointName); err != nil {
+		r.log.Errorf("failed to delete the floating IP of [ %s ]: %s", endpointName, err)
+	}
 
-	if err := d.deleteEndpoint(bridgeName, endpointName); err != nil {
+	if err := d.deleteEndpoint(r, bridgeName, endpointName); err != nil {
 		return fmt.Errorf("ovn failed to set endpoint addr")
 	}
 
@@ -410,12 +610,25 @@ func (d *Driver) DeleteEndpoint(req *network.DeleteEndpointRequest) error {
 
 // CreateNetwork creates a logical switch
 func (d *Driver) CreateNetwork(req *network.CreateNetworkRequest) error {
-	log.Infof("Create network request: %+v\n", req)
+	r := newRequest("CreateNetwork", req.NetworkID, "")
+	r.log.Infof("Create network request: %+v", req)
 
 	bridgeName, err := getBridgeName(req)
 	if err != nil {
 		return err
 	}
+	// a network on a pool of the OVN IPAM driver uses the switch of the pool
+	pool := getIPAMPool(req)
+	if pool != "" {
+		poolSwitch, err := d.ovnnber.findPoolSwitch(pool)
+		if err != nil {
+			return err
+		}
+		if poolSwitch == "" {
+			return fmt.Errorf("failed to find the logical switch of pool [ %s ]", pool)
+		}
+		bridgeName = poolSwitch
+	}
 	log.Debugf("Bridge name: [ %s ]", bridgeName)
 
 	mtu, err := getBridgeMTU(req)
@@ -430,10 +643,21 @@ func (d *Driver) CreateNetwork(req *network.CreateNetworkRequest) error {
 	}
 	log.Debugf("Mode: [ %v ]", mode)
 
-	gateway, mask, err := getGatewayIP(req)
+	dynamic, err := getAddressesMode(req)
 	if err != nil {
 		return err
 	}
+	log.Debugf("Dynamic addresses: [ %v ]", dynamic)
+
+	gateway, mask, err := getGatewayIP(req)
+	if err != nil {
+		// a network with dynamic addresses may have no pool, as with the
+		// null IPAM driver, and thus no gateway
+		if !dynamic {
+			return err
+		}
+		gateway, mask = "", ""
+	}
 	log.Debugf("Gateway mask: [ %v/%v ]", gateway, mask)
 
 	bindInterface, err := getBindInterface(req)
@@ -442,6 +666,28 @@ func (d *Driver) CreateNetwork(req *network.CreateNetworkRequest) error {
 	}
 	log.Debugf("Bindinterface: [ %v ]", bindInterface)
 
+	vlan, err := getVLAN(req)
+	if err != nil {
+		return err
+	}
+	if vlan != 0 && mode != modeFlat {
+		return fmt.Errorf("%s needs %s=%s", vlanOption, modeOption, modeFlat)
+	}
+	physicalNetwork := getPhysicalNetwork(req)
+	log.Debugf("Physical network: [ %v %v ]", physicalNetwork, vlanString(vlan))
+
+	joinWait, joinWaitTimeout, err := getJoinWait(req)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Join wait: [ %v %v ]", joinWait, joinWaitTimeout)
+
+	tenant, err := getTenant(req)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Tenant: [ %v ]", tenant)
+
 	ns := &NetworkState{
 		id:                req.NetworkID,
 		BridgeName:        bridgeName,
@@ -450,17 +696,67 @@ func (d *Driver) CreateNetwork(req *network.CreateNetworkRequest) error {
 		Gateway:           gateway,
 		GatewayMask:       mask,
 		FlatBindInterface: bindInterface,
+		DynamicAddresses:  dynamic,
+		JoinWait:          joinWait,
+		JoinWaitTimeout:   joinWaitTimeout,
+		Tenant:            tenant,
+		PhysicalNetwork:   physicalNetwork,
+		VLAN:              vlan,
+		subnet:            getSubnet(req),
+	}
+	d.setNetwork(ns)
+
+	// in local scope the hosts share the switch of a network by its name,
+	// which Docker only stores once the network is created
+	if config.Scope == scopeLocal && pool == "" {
+		ns.pending = true
+		r.log.Infof("Deferred the logical bridge of network id [ %v ] to its first endpoint", req.NetworkID)
+		return nil
+	}
+
+	if err := d.initNetwork(r, ns); err != nil {
+		d.netmu.Lock()
+		delete(d.networks, req.NetworkID)
+		d.netmu.Unlock()
+		return err
 	}
-	d.netmu.Lock()
-	d.netmu.Unlock()
-	d.networks[req.NetworkID] = ns
+	r.log.Infof("Created logical bridge [ %s ] for network id [ %v ]", ns.BridgeName, req.NetworkID)
+	return nil
+}
 
-	log.Debugf("Initializing bridge for network %s", req.NetworkID)
-	if err := d.initBridge(req.NetworkID); err != nil {
-		delete(d.networks, req.NetworkID)
+// initNetwork creates the logical switch of a network, if needed, records
+// the network state on it and connects it as the network says
+func (d *Driver) initNetwork(r *request, ns *NetworkState) error {
+	// the switch may already exist, e.g. the one of a pool or one named by
+	// the bridge name option, and must not be shared with another tenant
+	if err := d.ovnnber.checkTenant("Logical_Switch", ns.BridgeName, ns.Tenant); err != nil {
 		return err
 	}
-	log.Infof("Created logical bridge [ %s ] for network id [ %v ]", ns.BridgeName, req.NetworkID)
+
+	r.log.Debugf("Initializing bridge for network %s", ns.id)
+	if err := d.initBridge(r, ns); err != nil {
+		return err
+	}
+	// the other hosts learn the network from its switch, which also gives
+	// the switch of a pool its net-id
+	if err := d.ovnnber.saveNetworkState(r, ns); err != nil {
+		return err
+	}
+	if ns.Mode == modeFlat {
+		if err := d.initProviderNetwork(r, ns); err != nil {
+			return err
+		}
+	}
+	if ns.DynamicAddresses {
+		if err := d.initDynamicAddresses(r, ns.BridgeName, ns.subnet, ns.Gateway); err != nil {
+			return err
+		}
+	}
+	if routerName := networkRouter(ns.Tenant); routerName != "" && ns.Gateway != "" {
+		if err := d.ovnnber.attachRouter(r, routerName, ns.BridgeName, ns.Gateway, ns.GatewayMask, ns.Tenant); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -482,10 +778,10 @@ func (d *Driver) DiscoverNew(notif *network.DiscoveryNotification) error {
 // EndpointInfo gets the endpoint info
 func (d *Driver) EndpointInfo(req *network.InfoRequest) (*network.InfoResponse, error) {
 	log.Infof("Request EndpointInfo %+v", req)
-	if _, ok := d.endpoints[req.EndpointID]; !ok {
+	ep, ok := d.endpoint(req.EndpointID)
+	if !ok {
 		return nil, fmt.Errorf("failed to find endpoint for id [ %s ]", req.NetworkID)
 	}
-	ep := d.endpoints[req.EndpointID]
 
 	log.Infof("Request EndpointInfo [ %s %s %s]", ep.addr, ep.mac, ep.vethOut)
 
@@ -508,25 +804,27 @@ func (d *Driver) FreeNetwork(req *network.FreeNetworkRequest) error {
 // GetCapabilities returns scope
 func (d *Driver) GetCapabilities() (*network.CapabilitiesResponse, error) {
 	res := &network.CapabilitiesResponse{
-		Scope: network.GlobalScope,
+		Scope: config.Scope,
 	}
 	return res, nil
 }
 
 // Join is invoked when a Sandbox is attached to an endpoint.
-func (d *Driver) Join(req *network.JoinRequest) (*network.JoinResponse, error) {
-	log.Infof("Join request: %+v", req)
+func (d *Driver) Join(req *network.JoinRequest) (res *network.JoinResponse, err error) {
+	r := newRequest("Join", req.NetworkID, req.EndpointID)
+	r.log.Infof("Join request: %+v", req)
 
-	if _, ok := d.networks[req.NetworkID]; !ok {
+	ns, ok := d.network(req.NetworkID)
+	if !ok {
 		return nil, fmt.Errorf("failed to find logical switch for network id [ %s ]", req.NetworkID)
 	}
-	bridgeName := d.networks[req.NetworkID].BridgeName
+	bridgeName := ns.BridgeName
 	log.Infof("Bridge name: %s", bridgeName)
 
-	if _, ok := d.endpoints[req.EndpointID]; !ok {
+	ep, ok := d.endpoint(req.EndpointID)
+	if !ok {
 		return nil, fmt.Errorf("failed to find endpoint for id [ %s ]", req.NetworkID)
 	}
-	ep := d.endpoints[req.EndpointID]
 	log.Infof("Endpoint name: %s [%s %s]", ep.LogicalPortName, ep.mac, ep.addr)
 
 	if req.SandboxKey == "" {
@@ -534,18 +832,33 @@ func (d *Driver) Join(req *network.JoinRequest) (*network.JoinResponse, error) {
 	}
 	sboxkey := req.SandboxKey
 	log.Infof("Sandbox key: %s", sboxkey)
+	// a container on networks of two tenants would route between them
+	if err := d.claimSandbox(ep, sboxkey, ns.Tenant); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			d.releaseSandbox(ep)
+		}
+	}()
 	s := strings.Split(sboxkey, "/")
 	cnid := s[len(s)-1]
 	log.Infof("Sandbox cni key: %s", cnid)
 
 	vethOut := req.EndpointID[0:15]
 	vethIn := req.EndpointID[0:13] + "_c"
-	if err := createVethPair(vethOut, vethIn, ep.mac); err != nil {
+	if nested() {
+		if err := d.joinNested(r, ep, vethOut); err != nil {
+			return nil, err
+		}
+		return d.joined(r, req, ep)
+	}
+	if err := createVethPair(r, vethOut, vethIn, ep.mac); err != nil {
 		return nil, fmt.Errorf("failed to create veth pair")
 	}
 	ep.vethOut = vethOut
 	ep.vethIn = vethIn
-	log.Debugf("Created veth %s:%s", ep.vethOut, ep.vethIn)
+	r.log.Debugf("Created veth %s:%s", ep.vethOut, ep.vethIn)
 
 	// ovs_vsctl("add-port", OVN_BRIDGE, veth_outside)
 	// ovs_vsctl("set", "interface", veth_outside,
@@ -553,54 +866,92 @@ func (d *Driver) Join(req *network.JoinRequest) (*network.JoinResponse, error) {
 	//	"external_ids:iface-id=" + eid,
 	//	"external_ids:vm-id=" + vm_id,
 	//	"external_ids:iface-status=active")
-	if err := d.addVethPort(ovnbridge, vethOut, ep.mac, ep.LogicalPortName, cnid); err != nil {
+	if err := d.addVethPort(r, d.ovsdber.bridge, vethOut, ep.mac, ep.LogicalPortName, cnid); err != nil {
 		return nil, fmt.Errorf("ovn failed to join endpoint [ %s ] to sb [ %s ]", vethOut, sboxkey)
 	}
 
+	return d.joined(r, req, ep)
+}
+
+// joined completes the Join of an endpoint plugged into OVN
+func (d *Driver) joined(r *request, req *network.JoinRequest, ep *EndpointState) (*network.JoinResponse, error) {
+	ns, _ := d.network(req.NetworkID)
+	if err := d.waitJoined(r, ns, ep.LogicalPortName); err != nil {
+		d.unplugVeth(r, ep)
+		return nil, err
+	}
+	if ep.floatingIP != "" {
+		if err := d.ovnnber.addFloatingIP(r, networkRouter(ns.Tenant), ep.floatingIP, ep, ns.Tenant); err != nil {
+			d.unplugVeth(r, ep)
+			return nil, err
+		}
+	}
+	d.joinLabels(r, ns, ep, req.EndpointID)
+
 	res := &network.JoinResponse{
 		InterfaceName: network.InterfaceName{
 			SrcName:   ep.vethIn,
-			DstPrefix: containerEthName,
+			DstPrefix: config.ContainerEthName,
 		},
-		Gateway: d.networks[req.NetworkID].Gateway,
+		Gateway: ns.Gateway,
 	}
-	log.Debugf("Join endpoint %s:%s to %s", req.NetworkID, req.EndpointID, req.SandboxKey)
+	r.log.Debugf("Join endpoint %s:%s to %s", req.NetworkID, req.EndpointID, req.SandboxKey)
 
 	return res, nil
 }
 
 // Leave method is invoked when a Sandbox detaches from an endpoint.
 func (d *Driver) Leave(req *network.LeaveRequest) error {
-	log.Infof("Leave request: %+v", req)
+	r := newRequest("Leave", req.NetworkID, req.EndpointID)
+	r.log.Infof("Leave request: %+v", req)
 
-	if _, ok := d.networks[req.NetworkID]; !ok {
+	ns, ok := d.network(req.NetworkID)
+	if !ok {
 		return fmt.Errorf("failed to find logical switch for network id [ %s ]", req.NetworkID)
 	}
-	bridgeName := d.networks[req.NetworkID].BridgeName
+	bridgeName := ns.BridgeName
 	log.Infof("Bridge name: %s", bridgeName)
 
-	if _, ok := d.endpoints[req.EndpointID]; !ok {
+	ep, ok := d.endpoint(req.EndpointID)
+	if !ok {
 		return fmt.Errorf("failed to find endpoint for id [ %s ]", req.NetworkID)
 	}
-	ep := d.endpoints[req.EndpointID]
 	log.Debugf("Endpoint name: %s [%s %s %s]", ep.LogicalPortName, ep.mac, ep.addr, ep.vethOut)
 
+	if err := d.leaveLabels(r, ns, ep); err != nil {
+		r.log.Errorf("failed to remove endpoint [ %s ] from its service: %s", req.EndpointID, err)
+	}
+	if err := d.ovnnber.deleteFloatingIP(r, networkRouter(ns.Tenant), ep.LogicalPortName); err != nil {
+		r.log.Errorf("failed to delete the floating IP of [ %s ]: %s", ep.LogicalPortName, err)
+	}
+
+	// the VLAN subinterface of nested mode is gone with the container's
+	// namespace unless libnetwork moved it back
+	if nested() {
+		d.unplugVeth(r, ep)
+		d.forgetEndpoint(req.EndpointID)
+		r.log.Infof("Deleted VLAN [ %s ] of port [ %s ]", ep.vethOut, ep.LogicalPortName)
+		return nil
+	}
+
 	// command = "ip link delete %s" % (veth_outside)
 	iface, err := netlink.LinkByName(ep.vethOut)
 	if err != nil {
 		return fmt.Errorf("Error retrieving a link named [ %s ]", iface.Attrs().Name)
 	}
-	if err := netlink.LinkDel(iface); err != nil {
-		log.Errorf("unable to delete veth on leave: %s", err)
+	err = netlink.LinkDel(iface)
+	r.auditLink("delete", ep.vethOut, err)
+	if err != nil {
+		r.log.Errorf("unable to delete veth on leave: %s", err)
 	}
-	log.Infof("Deleted link veth [ %s ]", ep.vethOut)
+	r.log.Infof("Deleted link veth [ %s ]", ep.vethOut)
 
 	// ovs_vsctl("--if-exists", "del-port", veth_outside)
-	if err := d.ovsdber.deletePort(ovnbridge, ep.vethOut); err != nil {
+	if err := d.ovsdber.deletePort(r, d.ovsdber.bridge, ep.vethOut); err != nil {
 		return fmt.Errorf("ovs failed to delete port")
 	}
-	delete(d.endpoints, req.EndpointID)
-	log.Infof("Deleted port [ %s ] on OVN bridge [ %v ]", ep.LogicalPortName, ovnbridge)
+	d.forgetEndpoint(req.EndpointID)
+	r.log.Infof("Deleted port [ %s ] on OVN bridge [ %v ]", ep.LogicalPortName, d.ovsdber.bridge)
 	return nil
 }
 
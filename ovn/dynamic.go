@@ -0,0 +1,177 @@
+package ovn
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/socketplane/libovsdb"
+)
+
+// dynamicAddressPoll is the pause between two reads of dynamic_addresses
+const dynamicAddressPoll = 200 * time.Millisecond
+
+func getAddressesMode(r *network.CreateNetworkRequest) (bool, error) {
+	if r.Options != nil {
+		if mode, ok := r.Options[addressesOption].(string); ok {
+			if !validAddresses[mode] {
+				return false, fmt.Errorf("%s is not a valid addresses mode", mode)
+			}
+			return mode == addressesDynamic, nil
+		}
+	}
+	return false, nil
+}
+
+func getSubnet(r *network.CreateNetworkRequest) string {
+	if r.Options != nil {
+		if subnet, ok := r.Options[subnetOption].(string); ok {
+			return subnet
+		}
+	}
+	return ""
+}
+
+// initDynamicAddresses prepares the logical switch of a network whose
+// addresses ovn-northd assigns: other_config:subnet is set from subnet, or
+// must have been set on the switch beforehand. The gateway is excluded from
+// the assigned addresses.
+func (d *Driver) initDynamicAddresses(r *request, bridgeName, subnet, gateway string) error {
+	if subnet != "" {
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil || ipnet.IP.To4() == nil {
+			return fmt.Errorf("invalid IPv4 subnet [ %s ]", subnet)
+		}
+		if err := d.ovnnber.setOtherConfig(r, bridgeName, "subnet", ipnet.String()); err != nil {
+			return err
+		}
+	}
+
+	ipnet, excludeIPs, err := d.ovnnber.getPool(bridgeName)
+	if err != nil {
+		return fmt.Errorf("dynamic addresses need the %s option or other_config:subnet on the logical switch: %s", subnetOption, err)
+	}
+	if gw := net.ParseIP(gateway); gw != nil && ipnet.Contains(gw) && !isExcluded(gw, excludeIPs) {
+		excludeIPs = append(excludeIPs, gw.String())
+		return d.ovnnber.setOtherConfig(r, bridgeName, "exclude_ips", strings.Join(excludeIPs, " "))
+	}
+	return nil
+}
+
+// createDynamicEndpoint creates the logical port of an endpoint that Docker
+// gave no address, and returns the addresses ovn-northd assigns to it
+func (d *Driver) createDynamicEndpoint(r *request, req *network.CreateEndpointRequest, bridgeName, logicalPortName, floatingIP string) (*network.CreateEndpointResponse, error) {
+	var macaddr string
+	if req.Interface != nil {
+		macaddr = req.Interface.MacAddress
+	}
+
+	es := &EndpointState{
+		LogicalPortName: logicalPortName,
+		networkID:       req.NetworkID,
+		floatingIP:      floatingIP,
+	}
+	d.setEndpoint(req.EndpointID, es)
+
+	if err := d.createEndpoint(r, bridgeName, logicalPortName); err != nil {
+		d.forgetEndpoint(req.EndpointID)
+		return nil, fmt.Errorf("ovn failed to create endpoint")
+	}
+	cleanup := func() {
+		d.deleteEndpoint(r, bridgeName, logicalPortName)
+		d.forgetEndpoint(req.EndpointID)
+	}
+
+	ns, _ := d.network(req.NetworkID)
+	if err := d.ovnnber.tagTenant(r, "Logical_Switch_Port", logicalPortName, ns.Tenant); err != nil {
+		cleanup()
+		return nil, err
+	}
+	if err := d.ovnnber.setLogicalPortDynamic(r, logicalPortName, macaddr); err != nil {
+		cleanup()
+		return nil, fmt.Errorf("ovn failed to set endpoint addr")
+	}
+
+	mac, ipaddr, err := d.ovnnber.waitDynamicAddresses(logicalPortName, config.DynamicAddressTimeout.Duration)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	subnet, _, err := d.ovnnber.getPool(bridgeName)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	ones, _ := subnet.Mask.Size()
+	es.addr = ipaddr
+	es.mac = mac
+	r.log.Debugf("Dynamic addr [ %s ] mac [ %s ]", ipaddr, mac)
+
+	if m := portSecurityMutation(ipaddr, mac); m != nil {
+		if err := d.ovnnber.mutateLogicalPort(r, logicalPortName, m); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("ovn failed to set endpoint port security")
+		}
+	}
+
+	iface := &network.EndpointInterface{
+		Address: fmt.Sprintf("%s/%d", ipaddr, ones),
+	}
+	// libnetwork rejects a MAC address it has chosen being changed
+	if macaddr == "" {
+		iface.MacAddress = mac
+	}
+	r.log.Infof("Created logical port [ %s ] with dynamic addresses for endpoint id [ %v ]", logicalPortName, req.EndpointID)
+	return &network.CreateEndpointResponse{Interface: iface}, nil
+}
+
+// setLogicalPortDynamic asks ovn-northd for the addresses of a port, keeping
+// macaddr when given
+func (ovnnber *ovnnber) setLogicalPortDynamic(r *request, logicalPortName, macaddr string) error {
+	addresses := addressesDynamic
+	if macaddr != "" {
+		addresses = macaddr + " " + addressesDynamic
+	}
+	addrSet, _ := libovsdb.NewOvsSet([]string{addresses})
+	return ovnnber.mutateLogicalPort(r, logicalPortName, libovsdb.NewMutation("addresses", "insert", addrSet))
+}
+
+// mutateLogicalPort applies mutations to a logical switch port
+func (ovnnber *ovnnber) mutateLogicalPort(r *request, logicalPortName string, mutations ...interface{}) error {
+	mutateOp := libovsdb.Operation{
+		Op:        "mutate",
+		Table:     "Logical_Switch_Port",
+		Mutations: mutations,
+		Where:     []interface{}{libovsdb.NewCondition("name", "==", logicalPortName)},
+	}
+	return ovnnber.transactOps(r, mutateOp)
+}
+
+// waitDynamicAddresses waits for ovn-northd to fill dynamic_addresses of a
+// port and returns its MAC and IPv4 addresses
+func (ovnnber *ovnnber) waitDynamicAddresses(logicalPortName string, timeout time.Duration) (mac, ipaddr string, err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		rows, err := ovnnber.selectRows("Logical_Switch_Port", libovsdb.NewCondition("name", "==", logicalPortName))
+		if err != nil {
+			return "", "", err
+		}
+		if len(rows) == 0 {
+			return "", "", fmt.Errorf("failed to find logical port [ %s ]", logicalPortName)
+		}
+		// an empty optional column is an empty set rather than a string
+		if dynamic, ok := rows[0]["dynamic_addresses"].(string); ok {
+			fields := strings.Fields(dynamic)
+			if len(fields) >= 2 && net.ParseIP(fields[1]).To4() != nil {
+				return fields[0], fields[1], nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return "", "", fmt.Errorf("ovn-northd assigned no address to logical port [ %s ] within %v", logicalPortName, timeout)
+		}
+		time.Sleep(dynamicAddressPoll)
+	}
+}
@@ -0,0 +1,160 @@
+package ovn
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/socketplane/libovsdb"
+)
+
+const (
+	// floatingIPOption, as an endpoint option or a container label, gives
+	// the container a floating IP: a dnat_and_snat NAT of the router of the
+	// network, distributed on the chassis of its logical port. A floating IP
+	// in use fails the endpoint of the option, but the label is only looked
+	// up once Join returned: the container then runs without it and the
+	// Join logs a warning.
+	floatingIPOption = "net.libnetwork.ovn.floating_ip"
+
+	natDNATAndSNAT = "dnat_and_snat"
+)
+
+func parseFloatingIP(s string) (string, error) {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() == nil {
+		return "", fmt.Errorf("%s is not a valid %s", s, floatingIPOption)
+	}
+	return ip.String(), nil
+}
+
+func getFloatingIP(r *network.CreateEndpointRequest) (string, error) {
+	if r.Options != nil {
+		if s, ok := r.Options[floatingIPOption].(string); ok && s != "" {
+			return parseFloatingIP(s)
+		}
+	}
+	return "", nil
+}
+
+// checkFloatingIP fails when another logical port than logicalPortName has
+// the floating IP, on any router of the OVN Northbound
+func (ovnnber *ovnnber) checkFloatingIP(floatingIP, logicalPortName string) error {
+	rows, err := ovnnber.selectRows("NAT", libovsdb.NewCondition("external_ip", "==", floatingIP))
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if port := getRowSet(row, "logical_port"); len(port) == 0 || port[0] != logicalPortName {
+			return fmt.Errorf("floating IP [ %s ] is already in use", floatingIP)
+		}
+	}
+	return nil
+}
+
+// addFloatingIP adds the dnat_and_snat NAT of the floating IP of an endpoint
+// to the router of the network, with the logical port and an external MAC
+// so that the chassis of the port does the NAT, as ovn-nbctl lr-nat-add does
+func (ovnnber *ovnnber) addFloatingIP(r *request, routerName, floatingIP string, ep *EndpointState, tenant string) error {
+	if routerName == "" {
+		return fmt.Errorf("floating IP [ %s ] needs the network to be attached to a router", floatingIP)
+	}
+	rows, err := ovnnber.selectRows("NAT", libovsdb.NewCondition("external_ip", "==", floatingIP))
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if port := getRowSet(row, "logical_port"); len(port) > 0 && port[0] == ep.LogicalPortName {
+			return nil
+		}
+	}
+	if len(rows) > 0 {
+		return fmt.Errorf("floating IP [ %s ] is already in use", floatingIP)
+	}
+	r.log.Infof("Add floating IP [ %s ] of logical port [ %s ] to router [ %s ]", floatingIP, ep.LogicalPortName, routerName)
+
+	namedNATUUID := "nat"
+	externalIDs, _ := libovsdb.NewOvsMap(tenantExternalIDs(tenant))
+	nat := make(map[string]interface{})
+	nat["type"] = natDNATAndSNAT
+	nat["external_ip"] = floatingIP
+	nat["logical_ip"] = endpointIP(ep)
+	nat["logical_port"] = ep.LogicalPortName
+	nat["external_mac"] = makeMac(net.ParseIP(floatingIP))
+	nat["external_ids"] = externalIDs
+	insertOp := libovsdb.Operation{
+		Op:       "insert",
+		Table:    "NAT",
+		Row:      nat,
+		UUIDName: namedNATUUID,
+	}
+
+	natSet, _ := libovsdb.NewOvsSet([]libovsdb.UUID{{GoUUID: namedNATUUID}})
+	mutateOp := libovsdb.Operation{
+		Op:        "mutate",
+		Table:     "Logical_Router",
+		Mutations: []interface{}{libovsdb.NewMutation("nat", "insert", natSet)},
+		Where:     []interface{}{libovsdb.NewCondition("name", "==", routerName)},
+	}
+	// external_ip is not unique: the wait fails when another host added the
+	// floating IP since it was looked up. libovsdb omits empty rows, so it
+	// waits until the NATs of the IP are not the one NAT of the IP.
+	waitOp := libovsdb.Operation{
+		Op:      "wait",
+		Table:   "NAT",
+		Where:   []interface{}{libovsdb.NewCondition("external_ip", "==", floatingIP)},
+		Columns: []string{"external_ip"},
+		Until:   "!=",
+		Rows:    []map[string]interface{}{{"external_ip": floatingIP}},
+		Timeout: waitTimeout,
+	}
+	err = ovnnber.transactWait(r, waitOp, insertOp, mutateOp)
+	if err == errConflict {
+		return fmt.Errorf("floating IP [ %s ] is already in use", floatingIP)
+	}
+	return err
+}
+
+// deleteFloatingIP removes the floating IP of a logical port, if any, from
+// the router. The NAT rows are not roots, OVSDB deletes them with their
+// last reference.
+func (ovnnber *ovnnber) deleteFloatingIP(r *request, routerName, logicalPortName string) error {
+	if routerName == "" {
+		return nil
+	}
+	rows, err := ovnnber.selectRows("NAT", libovsdb.NewCondition("logical_port", "==", logicalPortName))
+	if err != nil {
+		return err
+	}
+	var uuids []libovsdb.UUID
+	for _, row := range rows {
+		if natType, _ := row["type"].(string); natType == natDNATAndSNAT {
+			uuids = append(uuids, libovsdb.UUID{GoUUID: getRowUUID(row)})
+			r.log.Infof("Delete floating IP [ %v ] of logical port [ %s ] from router [ %s ]", row["external_ip"], logicalPortName, routerName)
+		}
+	}
+	if len(uuids) == 0 {
+		return nil
+	}
+	natSet, _ := libovsdb.NewOvsSet(uuids)
+	mutateOp := libovsdb.Operation{
+		Op:        "mutate",
+		Table:     "Logical_Router",
+		Mutations: []interface{}{libovsdb.NewMutation("nat", "delete", natSet)},
+		Where:     []interface{}{libovsdb.NewCondition("name", "==", routerName)},
+	}
+	return ovnnber.transactOps(r, mutateOp)
+}
+
+// joinFloatingIP gives a joined endpoint the floating IP of the label of its
+// container, unless its endpoint option gave it one already
+func (d *Driver) joinFloatingIP(r *request, ns *NetworkState, ep *EndpointState, labels map[string]string) error {
+	if ep.floatingIP != "" || labels[floatingIPOption] == "" {
+		return nil
+	}
+	floatingIP, err := parseFloatingIP(labels[floatingIPOption])
+	if err != nil {
+		return err
+	}
+	return d.ovnnber.addFloatingIP(r, networkRouter(ns.Tenant), floatingIP, ep, ns.Tenant)
+}
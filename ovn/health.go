@@ -0,0 +1,105 @@
+package ovn
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// CheckResult is the status of one dependency of the plugin
+type CheckResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// HealthStatus is the liveness or readiness of the plugin with the status
+// of every dependency checked
+type HealthStatus struct {
+	OK     bool                   `json:"ok"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+func (h *HealthStatus) add(name string, err error) {
+	res := CheckResult{OK: err == nil}
+	if err != nil {
+		res.Error = err.Error()
+		h.OK = false
+	}
+	h.Checks[name] = res
+}
+
+func newHealthStatus() *HealthStatus {
+	return &HealthStatus{
+		OK:     true,
+		Checks: make(map[string]CheckResult),
+	}
+}
+
+// Liveness reports whether the plugin process is working: the goroutine
+// monitoring the OVN Northbound tables must be running
+func (d *Driver) Liveness() *HealthStatus {
+	h := newHealthStatus()
+	h.add("nb-monitor", d.ovnnber.checkMonitor())
+	return h
+}
+
+// Readiness reports whether the plugin can serve requests: the OVN
+// Northbound and, but in nested mode, local OVSDB connections must be up,
+// the table monitor running and the Docker daemon reachable
+func (d *Driver) Readiness() *HealthStatus {
+	h := newHealthStatus()
+	h.add("ovn-northbound", d.ovnnber.checkConnection())
+	h.add("nb-monitor", d.ovnnber.checkMonitor())
+	// a VM in nested mode has no local OVSDB
+	if !nested() {
+		h.add("ovsdb", d.ovsdber.checkConnection())
+	}
+	h.add("docker", d.dockerer.checkConnection())
+	return h
+}
+
+func (ovnnber *ovnnber) checkConnection() error {
+	if atomic.LoadInt32(&ovnnber.connected) == 0 {
+		return errors.New("disconnected, failing over")
+	}
+	return nil
+}
+
+func (ovnnber *ovnnber) checkMonitor() error {
+	if atomic.LoadInt32(&ovnnber.monitoring) == 0 {
+		return errors.New("monitor goroutine is not running")
+	}
+	return nil
+}
+
+func (ovsdber *ovsdber) checkConnection() error {
+	_, err := ovsdber.getOpenvSwitchRow()
+	return err
+}
+
+func (dockerer *dockerer) checkConnection() error {
+	_, err := dockerer.client.Version()
+	return err
+}
+
+// HealthHandler serves the liveness on /healthz and the readiness on
+// /readyz as JSON, with status 503 when not healthy
+func (d *Driver) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, d.Liveness())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, d.Readiness())
+	})
+	return mux
+}
+
+func writeHealth(w http.ResponseWriter, h *HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	if !h.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
@@ -0,0 +1,506 @@
+package ovn
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/samalba/dockerclient"
+	"github.com/socketplane/libovsdb"
+	"github.com/vishvananda/netlink"
+)
+
+// Inspector joins what Docker, the OVN databases, the local OVSDB and
+// netlink know about the networks and endpoints of the plugin, for the
+// operator commands. It only reads.
+type Inspector struct {
+	docker *dockerclient.DockerClient
+	nb     *ovnnber
+	sb     *libovsdb.OvsdbClient // nil when no southbound remote is known
+	ovsdb  *libovsdb.OvsdbClient
+	// SystemID is the chassis name of this host
+	SystemID string
+}
+
+// NetworkView is a docker network of the plugin and its logical switch
+type NetworkView struct {
+	ID            string          `json:"id"`
+	Name          string          `json:"name"`
+	LogicalSwitch string          `json:"logical_switch"`
+	SwitchFound   bool            `json:"switch_found"`
+	Subnet        string          `json:"subnet"`
+	Gateway       string          `json:"gateway"`
+	Tenant        string          `json:"tenant,omitempty"`
+	Ports         int             `json:"ports"`
+	Endpoints     []*EndpointView `json:"endpoints"`
+}
+
+// EndpointView is a container endpoint of the plugin on this host with its
+// logical port, OVS interface, veth and southbound binding
+type EndpointView struct {
+	Container        string   `json:"container"`
+	ContainerID      string   `json:"container_id"`
+	Network          string   `json:"network"`
+	NetworkID        string   `json:"network_id"`
+	EndpointID       string   `json:"endpoint_id"`
+	IP               string   `json:"ip"`
+	MAC              string   `json:"mac"`
+	LogicalPort      string   `json:"logical_port"`
+	LogicalSwitch    string   `json:"logical_switch"`
+	PortFound        bool     `json:"port_found"`
+	Addresses        []string `json:"addresses"`
+	DynamicAddresses string   `json:"dynamic_addresses,omitempty"`
+	Up               bool     `json:"up"`
+	Interface        string   `json:"interface"`
+	IfaceID          string   `json:"iface_id"`
+	OFPort           int      `json:"ofport"`
+	LinkState        string   `json:"link_state"`
+	IfaceError       string   `json:"iface_error,omitempty"`
+	Veth             string   `json:"veth"`
+	VethPeer         string   `json:"veth_peer"`
+	VethState        string   `json:"veth_state"`
+	VethUp           bool     `json:"veth_up"`
+	BindingFound     bool     `json:"binding_found"`
+	Chassis          string   `json:"chassis"`
+	ChassisHostname  string   `json:"chassis_hostname"`
+}
+
+// NewInspector connects to Docker and the databases. nbRemote and sbRemote
+// default to external_ids:ovn-nb and external_ids:ovn-remote of the local
+// Open_vSwitch; the southbound is optional.
+func NewInspector(nbRemote, sbRemote, ovsdbRemote string, sslConfig *SSLConfig) (*Inspector, error) {
+	docker, err := dockerclient.NewDockerClient("unix:///var/run/docker.sock", nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to docker: %s", err)
+	}
+	i := &Inspector{docker: docker}
+
+	if ovsdbRemote == "" {
+		ovsdbRemote = DefaultOvsdbRemote
+	}
+	if i.ovsdb, err = connectAny(ovsdbRemote, ovsdbPort, sslConfig); err != nil {
+		return nil, fmt.Errorf("could not connect to OVSDB: %s", err)
+	}
+	externalIDs, err := (&ovsdber{ovsdb: i.ovsdb}).getExternalIDs()
+	if err != nil {
+		i.Close()
+		return nil, err
+	}
+	i.SystemID = externalIDs["system-id"]
+
+	if nbRemote == "" {
+		nbRemote = externalIDs["ovn-nb"]
+	}
+	if nbRemote == "" {
+		nbRemote = DefaultNBRemote
+	}
+	nb, err := connectAny(nbRemote, ovnNBPort, sslConfig)
+	if err != nil {
+		i.Close()
+		return nil, fmt.Errorf("could not connect to OVN Northbound: %s", err)
+	}
+	i.nb = &ovnnber{ovsdb: nb}
+
+	if sbRemote == "" {
+		sbRemote = externalIDs["ovn-remote"]
+	}
+	if sbRemote != "" {
+		if i.sb, err = connectAny(sbRemote, ovnSBPort, sslConfig); err != nil {
+			i.Close()
+			return nil, fmt.Errorf("could not connect to OVN Southbound: %s", err)
+		}
+	}
+	return i, nil
+}
+
+// connectAny connects to the first reachable of a comma-separated list of
+// remotes, which is enough to read from a clustered database
+func connectAny(remotes string, defaultPort int, sslConfig *SSLConfig) (*libovsdb.OvsdbClient, error) {
+	rs, err := parseRemotes(remotes, defaultPort)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rs {
+		var client *libovsdb.OvsdbClient
+		if client, err = connectRemote(r, sslConfig); err == nil {
+			return client, nil
+		}
+	}
+	return nil, err
+}
+
+// Close disconnects from the databases
+func (i *Inspector) Close() {
+	for _, client := range []*libovsdb.OvsdbClient{i.ovsdb, i.sb} {
+		if client != nil {
+			client.Disconnect()
+		}
+	}
+	if i.nb != nil {
+		i.nb.ovsdb.Disconnect()
+	}
+}
+
+// HasSouthbound tells whether the southbound database could be reached
+func (i *Inspector) HasSouthbound() bool {
+	return i.sb != nil
+}
+
+// Networks lists the networks of the plugin with their endpoints
+func (i *Inspector) Networks() ([]*NetworkView, error) {
+	netlist, err := i.docker.ListNetworks("")
+	if err != nil {
+		return nil, fmt.Errorf("could not get docker networks: %s", err)
+	}
+
+	var views []*NetworkView
+	for _, nw := range netlist {
+		if nw.Driver != config.DriverName {
+			continue
+		}
+		netInspect, err := i.docker.InspectNetwork(nw.ID)
+		if err != nil {
+			return nil, fmt.Errorf("could not inspect docker network [ %s ]: %s", nw.Name, err)
+		}
+		view, err := i.networkView(netInspect)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, view)
+	}
+	sort.Slice(views, func(a, b int) bool { return views[a].Name < views[b].Name })
+	return views, nil
+}
+
+// Network returns the network of the plugin with the given name or id prefix
+func (i *Inspector) Network(nameOrID string) (*NetworkView, error) {
+	views, err := i.Networks()
+	if err != nil {
+		return nil, err
+	}
+	for _, view := range views {
+		if view.Name == nameOrID || strings.HasPrefix(view.ID, nameOrID) {
+			return view, nil
+		}
+	}
+	return nil, fmt.Errorf("no %s network [ %s ]", config.DriverName, nameOrID)
+}
+
+// Endpoints lists the endpoints of all networks of the plugin
+func (i *Inspector) Endpoints() ([]*EndpointView, error) {
+	views, err := i.Networks()
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []*EndpointView
+	for _, view := range views {
+		endpoints = append(endpoints, view.Endpoints...)
+	}
+	return endpoints, nil
+}
+
+// Endpoint returns the endpoint of the container with the given name or id
+// prefix, or the endpoint with the given id prefix. A container attached to
+// several networks of the plugin needs network to tell them apart.
+func (i *Inspector) Endpoint(nameOrID, network string) (*EndpointView, error) {
+	_, ep, err := i.lookupEndpoint(nameOrID, network)
+	return ep, err
+}
+
+// lookupEndpoint returns the endpoint Endpoint does with its network
+func (i *Inspector) lookupEndpoint(nameOrID, network string) (*NetworkView, *EndpointView, error) {
+	views, err := i.Networks()
+	if err != nil {
+		return nil, nil, err
+	}
+	var foundNetwork *NetworkView
+	var found []*EndpointView
+	for _, view := range views {
+		if network != "" && view.Name != network && !strings.HasPrefix(view.ID, network) {
+			continue
+		}
+		for _, ep := range view.Endpoints {
+			if ep.Container == nameOrID || strings.HasPrefix(ep.ContainerID, nameOrID) || strings.HasPrefix(ep.EndpointID, nameOrID) {
+				foundNetwork = view
+				found = append(found, ep)
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, nil, fmt.Errorf("no %s endpoint for [ %s ]", config.DriverName, nameOrID)
+	case 1:
+		return foundNetwork, found[0], nil
+	}
+	return nil, nil, fmt.Errorf("[ %s ] has %d %s endpoints, give the network", nameOrID, len(found), config.DriverName)
+}
+
+// networkSwitch returns the logical switch of a docker network of the plugin
+func (i *Inspector) networkSwitch(nw *dockerclient.NetworkResource) (string, error) {
+	bridgeName, err := getBridgeNamefromresource(nw)
+	if err != nil {
+		return "", err
+	}
+	if poolSwitch, err := i.nb.networkSwitch(nw.ID); err == nil && poolSwitch != "" {
+		bridgeName = poolSwitch
+	}
+	if config.Scope == scopeLocal {
+		if namedSwitch, err := i.nb.namedSwitch(nw.Name); err == nil && namedSwitch != "" {
+			bridgeName = namedSwitch
+		}
+	}
+	return bridgeName, nil
+}
+
+func (i *Inspector) networkView(nw *dockerclient.NetworkResource) (*NetworkView, error) {
+	bridgeName, err := i.networkSwitch(nw)
+	if err != nil {
+		return nil, err
+	}
+
+	view := &NetworkView{
+		ID:            nw.ID,
+		Name:          nw.Name,
+		LogicalSwitch: bridgeName,
+		Tenant:        nw.Options[tenantOption],
+		Endpoints:     []*EndpointView{},
+	}
+	if len(nw.IPAM.Config) > 0 {
+		view.Subnet = nw.IPAM.Config[0].Subnet
+		view.Gateway = nw.IPAM.Config[0].Gateway
+	}
+
+	rows, err := i.nb.selectRows("Logical_Switch", libovsdb.NewCondition("name", "==", bridgeName))
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) > 0 {
+		view.SwitchFound = true
+		view.Ports = len(getRowRefs(rows[0], "ports"))
+		if subnet := getRowMap(rows[0], "other_config")["subnet"]; subnet != "" {
+			view.Subnet = subnet
+		}
+		if tenant := getRowMap(rows[0], "external_ids")[tenantKey]; tenant != "" {
+			view.Tenant = tenant
+		}
+	}
+
+	for containerID, ep := range nw.Containers {
+		endpoint, err := i.endpointView(view, containerID, ep)
+		if err != nil {
+			return nil, err
+		}
+		view.Endpoints = append(view.Endpoints, endpoint)
+	}
+	sort.Slice(view.Endpoints, func(a, b int) bool { return view.Endpoints[a].Container < view.Endpoints[b].Container })
+	return view, nil
+}
+
+func (i *Inspector) endpointView(nw *NetworkView, containerID string, ep dockerclient.EndpointResource) (*EndpointView, error) {
+	view := &EndpointView{
+		Container:     ep.Name,
+		ContainerID:   containerID,
+		Network:       nw.Name,
+		NetworkID:     nw.ID,
+		EndpointID:    ep.EndpointID,
+		IP:            ep.IPv4Address,
+		MAC:           ep.MacAddress,
+		LogicalPort:   getLogicalPortNamefromresource(nw.ID, ep.EndpointID),
+		LogicalSwitch: nw.LogicalSwitch,
+		OFPort:        -1,
+	}
+	if len(ep.EndpointID) >= 15 {
+		view.Veth = ep.EndpointID[0:15]
+		view.VethPeer = ep.EndpointID[0:13] + "_c"
+	}
+
+	// northbound logical port
+	rows, err := i.nb.selectRows("Logical_Switch_Port", libovsdb.NewCondition("name", "==", view.LogicalPort))
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) > 0 {
+		view.PortFound = true
+		view.Addresses = getRowSet(rows[0], "addresses")
+		if dynamic := getRowSet(rows[0], "dynamic_addresses"); len(dynamic) > 0 {
+			view.DynamicAddresses = dynamic[0]
+		}
+		view.Up, _ = getRowBool(rows[0], "up")
+	}
+
+	// local OVS interface bound to the logical port
+	ifaceID, _ := libovsdb.NewOvsMap(map[string]string{"iface-id": view.LogicalPort})
+	rows, err = selectTable(i.ovsdb, "Open_vSwitch", "Interface", libovsdb.NewCondition("external_ids", "includes", ifaceID))
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) > 0 {
+		view.Interface, _ = rows[0]["name"].(string)
+		view.IfaceID = view.LogicalPort
+		if ofport, ok := getRowInt(rows[0], "ofport"); ok {
+			view.OFPort = ofport
+		}
+		if state := getRowSet(rows[0], "link_state"); len(state) > 0 {
+			view.LinkState = state[0]
+		}
+		if ifaceError := getRowSet(rows[0], "error"); len(ifaceError) > 0 {
+			view.IfaceError = ifaceError[0]
+		}
+	}
+
+	// host side of the veth pair
+	view.VethState = "missing"
+	if view.Veth != "" {
+		if link, err := netlink.LinkByName(view.Veth); err == nil {
+			view.VethState = link.Attrs().OperState.String()
+			view.VethUp = link.Attrs().Flags&net.FlagUp != 0
+		}
+	}
+
+	// southbound binding
+	if i.sb != nil {
+		if err := i.portBinding(view); err != nil {
+			return nil, err
+		}
+	}
+	return view, nil
+}
+
+// portBinding fills the chassis the logical port of view is bound to
+func (i *Inspector) portBinding(view *EndpointView) error {
+	rows, err := selectTable(i.sb, "OVN_Southbound", "Port_Binding", libovsdb.NewCondition("logical_port", "==", view.LogicalPort))
+	if err != nil || len(rows) == 0 {
+		return err
+	}
+	view.BindingFound = true
+	chassisUUID := getRowRef(rows[0], "chassis")
+	if chassisUUID == "" {
+		return nil
+	}
+	rows, err = selectTable(i.sb, "OVN_Southbound", "Chassis", libovsdb.NewCondition("_uuid", "==", libovsdb.UUID{GoUUID: chassisUUID}))
+	if err != nil || len(rows) == 0 {
+		return err
+	}
+	view.Chassis, _ = rows[0]["name"].(string)
+	view.ChassisHostname, _ = rows[0]["hostname"].(string)
+	return nil
+}
+
+// ServiceView is the load balancer of a service on a network of the plugin
+type ServiceView struct {
+	Name         string         `json:"name"`
+	Network      string         `json:"network"`
+	NetworkID    string         `json:"network_id"`
+	LoadBalancer string         `json:"load_balancer"`
+	VIPs         []string       `json:"vips"`
+	Protocol     string         `json:"protocol,omitempty"`
+	HealthCheck  bool           `json:"health_check"`
+	Backends     []*BackendView `json:"backends"`
+}
+
+// BackendView is a backend of a service, with its health as the southbound
+// Service_Monitor sees it when the service has health checks
+type BackendView struct {
+	IP          string `json:"ip"`
+	Port        int    `json:"port,omitempty"`
+	LogicalPort string `json:"logical_port,omitempty"`
+	// Status is online, offline or error, unknown before the first probe
+	// or without the southbound, and empty without health checks
+	Status string `json:"status,omitempty"`
+}
+
+// Services lists the services of the networks of the plugin, of network
+// only when it is not empty
+func (i *Inspector) Services(network string) ([]*ServiceView, error) {
+	netlist, err := i.docker.ListNetworks("")
+	if err != nil {
+		return nil, fmt.Errorf("could not get docker networks: %s", err)
+	}
+	views := []*ServiceView{}
+	for _, nw := range netlist {
+		if nw.Driver != config.DriverName {
+			continue
+		}
+		if network != "" && nw.Name != network && !strings.HasPrefix(nw.ID, network) {
+			continue
+		}
+		// in local scope the load balancers of the switch may carry the
+		// network ID of another host
+		bridgeName, err := i.networkSwitch(nw)
+		if err != nil {
+			return nil, err
+		}
+		rows, err := i.nb.switchLoadBalancers(bridgeName)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			view, err := i.serviceView(nw, row)
+			if err != nil {
+				return nil, err
+			}
+			views = append(views, view)
+		}
+	}
+	sort.Slice(views, func(a, b int) bool {
+		if views[a].Network != views[b].Network {
+			return views[a].Network < views[b].Network
+		}
+		return views[a].Name < views[b].Name
+	})
+	return views, nil
+}
+
+// serviceView is the service of the load balancer row on the switch of nw
+func (i *Inspector) serviceView(nw *dockerclient.NetworkResource, row map[string]interface{}) (*ServiceView, error) {
+	externalIDs := getRowMap(row, "external_ids")
+	view := &ServiceView{
+		Name:        externalIDs[serviceKey],
+		Network:     nw.Name,
+		NetworkID:   nw.ID,
+		Protocol:    externalIDs[serviceProtocolKey],
+		HealthCheck: len(getRowRefs(row, "health_check")) > 0,
+		Backends:    []*BackendView{},
+	}
+	view.LoadBalancer, _ = row["name"].(string)
+	for vip := range getRowMap(row, "vips") {
+		view.VIPs = append(view.VIPs, vip)
+	}
+	sort.Strings(view.VIPs)
+	if err := i.serviceBackends(view, serviceFromLB(externalIDs), splitBackends(externalIDs[serviceBackendsKey]), getRowMap(row, "ip_port_mappings")); err != nil {
+		return nil, err
+	}
+	return view, nil
+}
+
+// serviceBackends fills the backends of view, one per target port with the
+// health of each when the service has health checks
+func (i *Inspector) serviceBackends(view *ServiceView, svc *service, backends []string, ipPortMappings map[string]string) error {
+	for _, ip := range backends {
+		logicalPort := strings.Split(ipPortMappings[ip], ":")[0]
+		if !view.HealthCheck {
+			view.Backends = append(view.Backends, &BackendView{IP: ip, LogicalPort: logicalPort})
+			continue
+		}
+		for _, p := range svc.Ports {
+			backend := &BackendView{IP: ip, Port: p.TargetPort, LogicalPort: logicalPort, Status: "unknown"}
+			if i.sb != nil {
+				rows, err := selectTable(i.sb, "OVN_Southbound", "Service_Monitor",
+					libovsdb.NewCondition("ip", "==", ip),
+					libovsdb.NewCondition("port", "==", p.TargetPort),
+					libovsdb.NewCondition("logical_port", "==", logicalPort))
+				if err != nil {
+					return err
+				}
+				if len(rows) > 0 {
+					if status := getRowSet(rows[0], "status"); len(status) > 0 {
+						backend.Status = status[0]
+					}
+				}
+			}
+			view.Backends = append(view.Backends, backend)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,560 @@
+package ovn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/socketplane/libovsdb"
+)
+
+const (
+	// GlobalAddressSpace and LocalAddressSpace are the address spaces of the
+	// OVN IPAM driver
+	GlobalAddressSpace = "ovn"
+	LocalAddressSpace  = "ovn-local"
+
+	requestAddressType = "RequestAddressType"
+	gatewayAddressType = "com.docker.network.gateway"
+
+	// allocateRetries bounds the attempts to reserve a free address when
+	// other hosts reserve the same one concurrently
+	allocateRetries = 3
+)
+
+// IPAM is a libnetwork IPAM driver keeping address pools and allocations in
+// the OVN Northbound database. A pool is a Logical_Switch with
+// other_config:subnet and other_config:exclude_ips, which becomes the logical
+// switch of the network created on it. An allocated address is reserved by a
+// Logical_Switch_Port on that switch, which becomes the endpoint's port.
+type IPAM struct {
+	ovnnber *ovnnber
+	mu      sync.Mutex // serializes the allocations of this host
+}
+
+// NewIPAM returns the IPAM driver sharing the northbound connection of d
+func NewIPAM(d *Driver) *IPAM {
+	return &IPAM{ovnnber: &d.ovnnber}
+}
+
+// reservationName is the name of the logical switch port reserving addr in
+// the pool until an endpoint claims it
+func reservationName(poolID, addr string) string {
+	return "ipam-" + poolID + "-" + addr
+}
+
+// isOvnAddressSpace tells whether the pool of a network comes from the OVN
+// IPAM driver
+func isOvnAddressSpace(space string) bool {
+	return space == GlobalAddressSpace || space == LocalAddressSpace
+}
+
+// getIPAMPool returns the IPv4 pool of a network using the OVN IPAM driver
+func getIPAMPool(r *network.CreateNetworkRequest) string {
+	if len(r.IPv4Data) > 0 && r.IPv4Data[0] != nil && isOvnAddressSpace(r.IPv4Data[0].AddressSpace) {
+		return r.IPv4Data[0].Pool
+	}
+	return ""
+}
+
+// GetCapabilities returns the IPAM capabilities
+func (i *IPAM) GetCapabilities() (*ipam.CapabilitiesResponse, error) {
+	return &ipam.CapabilitiesResponse{RequiresMACAddress: false}, nil
+}
+
+// GetDefaultAddressSpaces returns the OVN address spaces
+func (i *IPAM) GetDefaultAddressSpaces() (*ipam.AddressSpacesResponse, error) {
+	return &ipam.AddressSpacesResponse{
+		LocalDefaultAddressSpace:  LocalAddressSpace,
+		GlobalDefaultAddressSpace: GlobalAddressSpace,
+	}, nil
+}
+
+// RequestPool creates the logical switch holding the pool. Addresses outside
+// the sub-pool, if any, are excluded from allocation.
+func (i *IPAM) RequestPool(req *ipam.RequestPoolRequest) (*ipam.RequestPoolResponse, error) {
+	r := newRequest("RequestPool", "", "")
+	r.log.Infof("Request pool request: %+v", req)
+
+	if req.V6 {
+		return nil, errors.New("the OVN IPAM driver does not support IPv6 pools")
+	}
+	if req.Pool == "" {
+		return nil, errors.New("the OVN IPAM driver needs a subnet")
+	}
+	_, subnet, err := net.ParseCIDR(req.Pool)
+	if err != nil || subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid IPv4 pool [ %s ]", req.Pool)
+	}
+
+	var excludeIPs []string
+	if req.SubPool != "" {
+		_, subPool, err := net.ParseCIDR(req.SubPool)
+		if err != nil || !subnet.Contains(subPool.IP) {
+			return nil, fmt.Errorf("invalid sub-pool [ %s ] of pool [ %s ]", req.SubPool, subnet)
+		}
+		excludeIPs = excludeOutside(subnet, subPool)
+	}
+
+	existing, err := i.ovnnber.findPoolSwitch(subnet.String())
+	if err != nil {
+		return nil, err
+	}
+	if existing != "" {
+		return nil, fmt.Errorf("pool [ %s ] is already in use by logical switch [ %s ]", subnet, existing)
+	}
+
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	poolID := config.BridgePrefix + id[:8]
+	addressSpace := req.AddressSpace
+	if addressSpace == "" {
+		addressSpace = GlobalAddressSpace
+	}
+	if err := i.ovnnber.createPool(r, poolID, addressSpace, subnet.String(), strings.Join(excludeIPs, " ")); err != nil {
+		return nil, err
+	}
+	r.log.Infof("Created pool [ %s ] on logical switch [ %s ]", subnet, poolID)
+
+	return &ipam.RequestPoolResponse{
+		PoolID: poolID,
+		Pool:   subnet.String(),
+		Data:   make(map[string]string),
+	}, nil
+}
+
+// ReleasePool deletes the logical switch of the pool
+func (i *IPAM) ReleasePool(req *ipam.ReleasePoolRequest) error {
+	r := newRequest("ReleasePool", "", "")
+	r.log.Infof("Release pool request: %+v", req)
+	return i.ovnnber.deleteSwitch(r, req.PoolID)
+}
+
+// excludeGateway returns the excluded addresses of a pool with its gateway,
+// the same when they exclude it already, e.g. as the network is created
+// again. It fails when the gateway is allocated to an endpoint.
+func excludeGateway(gateway net.IP, used map[string]bool, excludeIPs []string) ([]string, error) {
+	if used[gateway.String()] {
+		return nil, fmt.Errorf("gateway [ %s ] is already in use", gateway)
+	}
+	if isExcluded(gateway, excludeIPs) {
+		return excludeIPs, nil
+	}
+	return append(excludeIPs, gateway.String()), nil
+}
+
+// RequestAddress reserves the requested address, or the first free one, of
+// the pool. The gateway address is added to the excluded addresses instead,
+// as ovn-northd does not hand it out either.
+func (i *IPAM) RequestAddress(req *ipam.RequestAddressRequest) (*ipam.RequestAddressResponse, error) {
+	r := newRequest("RequestAddress", "", "")
+	r.log.Infof("Request address request: %+v", req)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	subnet, excludeIPs, err := i.ovnnber.getPool(req.PoolID)
+	if err != nil {
+		return nil, err
+	}
+	ones, _ := subnet.Mask.Size()
+	response := func(ip net.IP) *ipam.RequestAddressResponse {
+		return &ipam.RequestAddressResponse{
+			Address: fmt.Sprintf("%s/%d", ip, ones),
+			Data:    make(map[string]string),
+		}
+	}
+
+	var requested net.IP
+	if req.Address != "" {
+		requested = net.ParseIP(req.Address)
+		if requested == nil || !subnet.Contains(requested) {
+			return nil, fmt.Errorf("address [ %s ] is not in pool [ %s ]", req.Address, subnet)
+		}
+	}
+
+	if req.Options[requestAddressType] == gatewayAddressType {
+		gateway := requested
+		if gateway == nil {
+			gateway = uintToIP(ipToUint(subnet.IP) + 1)
+		}
+		used, err := i.ovnnber.poolAllocations(req.PoolID)
+		if err != nil {
+			return nil, err
+		}
+		gatewayExcludeIPs, err := excludeGateway(gateway, used, excludeIPs)
+		if err != nil {
+			return nil, err
+		}
+		if len(gatewayExcludeIPs) != len(excludeIPs) {
+			if err := i.ovnnber.setOtherConfig(r, req.PoolID, "exclude_ips", strings.Join(gatewayExcludeIPs, " ")); err != nil {
+				return nil, err
+			}
+			r.log.Infof("Excluded gateway [ %s ] from pool [ %s ]", gateway, req.PoolID)
+		}
+		return response(gateway), nil
+	}
+
+	for attempt := 0; attempt < allocateRetries; attempt++ {
+		used, err := i.ovnnber.poolAllocations(req.PoolID)
+		if err != nil {
+			return nil, err
+		}
+		ip := requested
+		if ip == nil {
+			if ip = firstFree(subnet, used, excludeIPs); ip == nil {
+				return nil, fmt.Errorf("no address left in pool [ %s ]", subnet)
+			}
+		} else if used[ip.String()] || isExcluded(ip, excludeIPs) {
+			return nil, fmt.Errorf("address [ %s ] is already in use", ip)
+		}
+
+		err = i.ovnnber.reserveAddress(r, req.PoolID, ip.String())
+		if err == nil {
+			r.log.Infof("Reserved address [ %s ] in pool [ %s ]", ip, req.PoolID)
+			return response(ip), nil
+		}
+		// another host reserved the same address in the meantime
+		r.log.Errorf("could not reserve address [ %s ]: %s", ip, err)
+		if requested != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("could not reserve an address in pool [ %s ]", subnet)
+}
+
+// ReleaseAddress frees an address of the pool: the port holding it, which
+// is normally gone with the endpoint already, or the gateway exclusion
+func (i *IPAM) ReleaseAddress(req *ipam.ReleaseAddressRequest) error {
+	r := newRequest("ReleaseAddress", "", "")
+	r.log.Infof("Release address request: %+v", req)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	addr := strings.Split(req.Address, "/")[0]
+	released, err := i.ovnnber.releaseAddress(r, req.PoolID, addr)
+	if err != nil || released {
+		return err
+	}
+
+	_, excludeIPs, err := i.ovnnber.getPool(req.PoolID)
+	if err != nil {
+		return err
+	}
+	var kept []string
+	for _, e := range excludeIPs {
+		if e != addr {
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) == len(excludeIPs) {
+		return nil
+	}
+	return i.ovnnber.setOtherConfig(r, req.PoolID, "exclude_ips", strings.Join(kept, " "))
+}
+
+// excludeOutside returns the exclude_ips ranges covering the addresses of
+// subnet that are outside subPool
+func excludeOutside(subnet, subPool *net.IPNet) []string {
+	first := uintToIP(ipToUint(subnet.IP) + 1)
+	last := lastHost(subnet)
+	subFirst := subPool.IP.Mask(subPool.Mask)
+	subLast := broadcast(subPool)
+
+	var excludes []string
+	if ipToUint(subFirst) > ipToUint(first) {
+		excludes = append(excludes, ipRange(first, uintToIP(ipToUint(subFirst)-1)))
+	}
+	if ipToUint(subLast) < ipToUint(last) {
+		excludes = append(excludes, ipRange(uintToIP(ipToUint(subLast)+1), last))
+	}
+	return excludes
+}
+
+func ipRange(from, to net.IP) string {
+	if from.Equal(to) {
+		return from.String()
+	}
+	return from.String() + ".." + to.String()
+}
+
+// isExcluded tells whether ip is in one of the exclude_ips entries, which
+// are single addresses or from..to ranges
+func isExcluded(ip net.IP, excludeIPs []string) bool {
+	n := ipToUint(ip)
+	for _, e := range excludeIPs {
+		bounds := strings.SplitN(e, "..", 2)
+		from := net.ParseIP(bounds[0])
+		to := from
+		if len(bounds) == 2 {
+			to = net.ParseIP(bounds[1])
+		}
+		if from == nil || to == nil {
+			continue
+		}
+		if n >= ipToUint(from) && n <= ipToUint(to) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstFree returns the lowest host address of subnet neither used nor
+// excluded, or nil when there is none
+func firstFree(subnet *net.IPNet, used map[string]bool, excludeIPs []string) net.IP {
+	last := ipToUint(lastHost(subnet))
+	for n := ipToUint(subnet.IP) + 1; n <= last; n++ {
+		ip := uintToIP(n)
+		if !used[ip.String()] && !isExcluded(ip, excludeIPs) {
+			return ip
+		}
+	}
+	return nil
+}
+
+func broadcast(subnet *net.IPNet) net.IP {
+	ip := subnet.IP.To4()
+	mask := subnet.Mask
+	b := make(net.IP, len(ip))
+	for i := range ip {
+		b[i] = ip[i] | ^mask[i]
+	}
+	return b
+}
+
+func lastHost(subnet *net.IPNet) net.IP {
+	return uintToIP(ipToUint(broadcast(subnet)) - 1)
+}
+
+func ipToUint(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uintToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// findPoolSwitch returns the name of the logical switch holding subnet, if any
+func (ovnnber *ovnnber) findPoolSwitch(subnet string) (string, error) {
+	subnetMap, _ := libovsdb.NewOvsMap(map[string]string{"subnet": subnet})
+	condition := libovsdb.NewCondition("other_config", "includes", subnetMap)
+	rows, err := ovnnber.selectRows("Logical_Switch", condition)
+	if err != nil || len(rows) == 0 {
+		return "", err
+	}
+	name, _ := rows[0]["name"].(string)
+	return name, nil
+}
+
+// getPool returns the subnet and the excluded addresses of a pool
+func (ovnnber *ovnnber) getPool(poolID string) (*net.IPNet, []string, error) {
+	rows, err := ovnnber.selectRows("Logical_Switch", libovsdb.NewCondition("name", "==", poolID))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil, fmt.Errorf("failed to find pool [ %s ]", poolID)
+	}
+	otherConfig := getRowMap(rows[0], "other_config")
+	_, subnet, err := net.ParseCIDR(otherConfig["subnet"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("logical switch [ %s ] has no valid other_config:subnet", poolID)
+	}
+	return subnet, strings.Fields(otherConfig["exclude_ips"]), nil
+}
+
+// poolAllocations returns the addresses reserved in a pool
+func (ovnnber *ovnnber) poolAllocations(poolID string) (map[string]bool, error) {
+	poolMap, _ := libovsdb.NewOvsMap(map[string]string{"ipam-pool": poolID})
+	condition := libovsdb.NewCondition("external_ids", "includes", poolMap)
+	rows, err := ovnnber.selectRows("Logical_Switch_Port", condition)
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+	for _, row := range rows {
+		if addr := getRowMap(row, "external_ids")["ipam-address"]; addr != "" {
+			used[addr] = true
+		}
+	}
+	return used, nil
+}
+
+// createPool inserts the logical switch of a pool
+func (ovnnber *ovnnber) createPool(r *request, poolID, addressSpace, subnet, excludeIPs string) error {
+	otherConfig := map[string]string{"subnet": subnet}
+	if excludeIPs != "" {
+		otherConfig["exclude_ips"] = excludeIPs
+	}
+	otherConfigMap, _ := libovsdb.NewOvsMap(otherConfig)
+	externalIDs, _ := libovsdb.NewOvsMap(map[string]string{
+		"ipam-pool":          poolID,
+		"ipam-address-space": addressSpace,
+	})
+
+	bridge := make(map[string]interface{})
+	bridge["name"] = poolID
+	bridge["other_config"] = otherConfigMap
+	bridge["external_ids"] = externalIDs
+
+	insertOp := libovsdb.Operation{
+		Op:    "insert",
+		Table: "Logical_Switch",
+		Row:   bridge,
+	}
+	return ovnnber.transactOps(r, insertOp)
+}
+
+// reserveAddress inserts the port reserving addr in the pool. Port names
+// are unique, so two hosts can not reserve the same address.
+func (ovnnber *ovnnber) reserveAddress(r *request, poolID, addr string) error {
+	namedPortUUID := "reservation"
+	externalIDs, _ := libovsdb.NewOvsMap(map[string]string{
+		"ipam-pool":    poolID,
+		"ipam-address": addr,
+	})
+
+	port := make(map[string]interface{})
+	port["name"] = reservationName(poolID, addr)
+	port["external_ids"] = externalIDs
+
+	insertPortOp := libovsdb.Operation{
+		Op:       "insert",
+		Table:    "Logical_Switch_Port",
+		Row:      port,
+		UUIDName: namedPortUUID,
+	}
+
+	mutateSet, _ := libovsdb.NewOvsSet([]libovsdb.UUID{{GoUUID: namedPortUUID}})
+	mutateOp := libovsdb.Operation{
+		Op:        "mutate",
+		Table:     "Logical_Switch",
+		Mutations: []interface{}{libovsdb.NewMutation("ports", "insert", mutateSet)},
+		Where:     []interface{}{libovsdb.NewCondition("name", "==", poolID)},
+	}
+	return ovnnber.transactOps(r, insertPortOp, mutateOp)
+}
+
+// claimAddress renames the port reserving addr on the switch to the
+// endpoint's port name. It reports false when addr was not reserved by the
+// OVN IPAM driver.
+func (ovnnber *ovnnber) claimAddress(r *request, switchName, addr, logicalPortName string) (bool, error) {
+	row := make(map[string]interface{})
+	row["name"] = logicalPortName
+	updateOp := libovsdb.Operation{
+		Op:    "update",
+		Table: "Logical_Switch_Port",
+		Row:   row,
+		Where: []interface{}{libovsdb.NewCondition("name", "==", reservationName(switchName, addr))},
+	}
+
+	operations := []libovsdb.Operation{updateOp}
+	reply, _ := transact(r, ovnnber.client(), "OVN_Northbound", operations...)
+
+	if len(reply) < len(operations) {
+		return false, errors.New("Number of Replies should be at least equal to number of Operations")
+	}
+	if reply[0].Error != "" {
+		return false, errors.New("Transaction Failed due to an error :" + reply[0].Error + " details : " + reply[0].Details)
+	}
+	return reply[0].Count > 0, nil
+}
+
+// releaseAddress removes the ports holding addr in the pool from its
+// switch, which deletes them. It reports whether there was any.
+func (ovnnber *ovnnber) releaseAddress(r *request, poolID, addr string) (bool, error) {
+	addrMap, _ := libovsdb.NewOvsMap(map[string]string{
+		"ipam-pool":    poolID,
+		"ipam-address": addr,
+	})
+	rows, err := ovnnber.selectRows("Logical_Switch_Port", libovsdb.NewCondition("external_ids", "includes", addrMap))
+	if err != nil || len(rows) == 0 {
+		return false, err
+	}
+
+	var uuids []libovsdb.UUID
+	for _, row := range rows {
+		uuids = append(uuids, libovsdb.UUID{GoUUID: getRowUUID(row)})
+	}
+	mutateSet, _ := libovsdb.NewOvsSet(uuids)
+	mutateOp := libovsdb.Operation{
+		Op:        "mutate",
+		Table:     "Logical_Switch",
+		Mutations: []interface{}{libovsdb.NewMutation("ports", "delete", mutateSet)},
+		Where:     []interface{}{libovsdb.NewCondition("name", "==", poolID)},
+	}
+	return true, ovnnber.transactOps(r, mutateOp)
+}
+
+// setOtherConfig sets one other_config key of a logical switch
+func (ovnnber *ovnnber) setOtherConfig(r *request, switchName, key, value string) error {
+	deleteSet, _ := libovsdb.NewOvsSet([]string{key})
+	mutations := []interface{}{libovsdb.NewMutation("other_config", "delete", deleteSet)}
+	if value != "" {
+		insertMap, _ := libovsdb.NewOvsMap(map[string]string{key: value})
+		mutations = append(mutations, libovsdb.NewMutation("other_config", "insert", insertMap))
+	}
+
+	mutateOp := libovsdb.Operation{
+		Op:        "mutate",
+		Table:     "Logical_Switch",
+		Mutations: mutations,
+		Where:     []interface{}{libovsdb.NewCondition("name", "==", switchName)},
+	}
+	return ovnnber.transactOps(r, mutateOp)
+}
+
+// networkSwitch returns the name of the logical switch of a docker network,
+// if it records the network id
+func (ovnnber *ovnnber) networkSwitch(netid string) (string, error) {
+	netMap, _ := libovsdb.NewOvsMap(map[string]string{"net-id": netid})
+	rows, err := ovnnber.selectRows("Logical_Switch", libovsdb.NewCondition("external_ids", "includes", netMap))
+	if err != nil || len(rows) == 0 {
+		return "", err
+	}
+	name, _ := rows[0]["name"].(string)
+	return name, nil
+}
+
+// deleteSwitch deletes a logical switch and, with it, its ports
+func (ovnnber *ovnnber) deleteSwitch(r *request, switchName string) error {
+	deleteOp := libovsdb.Operation{
+		Op:    "delete",
+		Table: "Logical_Switch",
+		Where: []interface{}{libovsdb.NewCondition("name", "==", switchName)},
+	}
+	return ovnnber.transactOps(r, deleteOp)
+}
+
+// selectRows returns the northbound rows of table matching condition
+func (ovnnber *ovnnber) selectRows(table string, condition interface{}) ([]map[string]interface{}, error) {
+	return selectTable(ovnnber.client(), "OVN_Northbound", table, condition)
+}
+
+// transactOps runs operations in one northbound transaction
+func (ovnnber *ovnnber) transactOps(r *request, operations ...libovsdb.Operation) error {
+	reply, err := transact(r, ovnnber.client(), "OVN_Northbound", operations...)
+	if err != nil {
+		return err
+	}
+
+	if len(reply) < len(operations) {
+		return errors.New("Number of Replies should be at least equal to number of Operations")
+	}
+	for _, o := range reply {
+		if o.Error != "" {
+			return errors.New("Transaction Failed due to an error :" + o.Error + " details : " + o.Details)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package ovn
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	_, subnet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("ParseCIDR(%q): %s", s, err)
+	}
+	return subnet
+}
+
+func TestLastHost(t *testing.T) {
+	for _, tc := range []struct {
+		subnet, want string
+	}{
+		{"10.0.0.0/24", "10.0.0.254"},
+		{"10.0.0.0/30", "10.0.0.2"},
+	} {
+		subnet := mustParseCIDR(t, tc.subnet)
+		if got := lastHost(subnet); got.String() != tc.want {
+			t.Errorf("lastHost(%s) = %s, want %s", tc.subnet, got, tc.want)
+		}
+		if subnet.String() != tc.subnet {
+			t.Errorf("lastHost changed the subnet to %s", subnet)
+		}
+	}
+}
+
+func TestIsExcluded(t *testing.T) {
+	excludeIPs := []string{"10.0.0.1", "10.0.0.10..10.0.0.20", "bogus"}
+	for _, tc := range []struct {
+		ip   string
+		want bool
+	}{
+		{"10.0.0.1", true},
+		{"10.0.0.2", false},
+		{"10.0.0.10", true},
+		{"10.0.0.15", true},
+		{"10.0.0.20", true},
+		{"10.0.0.21", false},
+	} {
+		if got := isExcluded(net.ParseIP(tc.ip), excludeIPs); got != tc.want {
+			t.Errorf("isExcluded(%s) = %t, want %t", tc.ip, got, tc.want)
+		}
+	}
+}
+
+func TestFirstFree(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		subnet     string
+		used       map[string]bool
+		excludeIPs []string
+		want       string
+	}{
+		{"empty /24", "10.0.0.0/24", nil, nil, "10.0.0.1"},
+		{"gateway excluded", "10.0.0.0/24", nil, []string{"10.0.0.1"}, "10.0.0.2"},
+		{"used and excluded", "10.0.0.0/24", map[string]bool{"10.0.0.2": true}, []string{"10.0.0.1", "10.0.0.3..10.0.0.9"}, "10.0.0.10"},
+		{"/30", "10.0.0.0/30", map[string]bool{"10.0.0.1": true}, nil, "10.0.0.2"},
+		{"full /30", "10.0.0.0/30", map[string]bool{"10.0.0.2": true}, []string{"10.0.0.1"}, ""},
+	} {
+		subnet := mustParseCIDR(t, tc.subnet)
+		got := firstFree(subnet, tc.used, tc.excludeIPs)
+		if (got == nil && tc.want != "") || (got != nil && got.String() != tc.want) {
+			t.Errorf("%s: firstFree = %v, want %q", tc.name, got, tc.want)
+		}
+		if subnet.String() != tc.subnet {
+			t.Errorf("%s: firstFree changed the subnet to %s", tc.name, subnet)
+		}
+	}
+}
+
+func TestExcludeGateway(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		gateway    string
+		used       map[string]bool
+		excludeIPs []string
+		want       []string
+		wantErr    bool
+	}{
+		{"first", "10.0.0.1", nil, nil, []string{"10.0.0.1"}, false},
+		{"appended", "10.0.0.1", map[string]bool{"10.0.0.2": true}, []string{"10.0.0.200..10.0.0.254"}, []string{"10.0.0.200..10.0.0.254", "10.0.0.1"}, false},
+		{"already excluded", "10.0.0.1", nil, []string{"10.0.0.1"}, []string{"10.0.0.1"}, false},
+		{"in an excluded range", "10.0.0.5", nil, []string{"10.0.0.1..10.0.0.9"}, []string{"10.0.0.1..10.0.0.9"}, false},
+		{"allocated", "10.0.0.1", map[string]bool{"10.0.0.1": true}, nil, nil, true},
+	} {
+		got, err := excludeGateway(net.ParseIP(tc.gateway), tc.used, tc.excludeIPs)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: excludeGateway error = %v, want error %t", tc.name, err, tc.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: excludeGateway = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestExcludeOutside(t *testing.T) {
+	for _, tc := range []struct {
+		subnet, subPool string
+		want            []string
+	}{
+		{"10.0.0.0/24", "10.0.0.0/24", nil},
+		{"10.0.0.0/24", "10.0.0.128/25", []string{"10.0.0.1..10.0.0.127"}},
+		{"10.0.0.0/24", "10.0.0.0/25", []string{"10.0.0.128..10.0.0.254"}},
+		{"10.0.0.0/24", "10.0.0.64/26", []string{"10.0.0.1..10.0.0.63", "10.0.0.128..10.0.0.254"}},
+		{"10.0.0.0/30", "10.0.0.2/31", []string{"10.0.0.1"}},
+	} {
+		subnet := mustParseCIDR(t, tc.subnet)
+		got := excludeOutside(subnet, mustParseCIDR(t, tc.subPool))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("excludeOutside(%s, %s) = %v, want %v", tc.subnet, tc.subPool, got, tc.want)
+		}
+		if subnet.String() != tc.subnet {
+			t.Errorf("excludeOutside changed the subnet to %s", subnet)
+		}
+	}
+}
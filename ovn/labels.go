@@ -0,0 +1,95 @@
+package ovn
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Docker lists a container on a network once its Join returned, so the
+	// labels are looked up after it, every labelsLookupPoll for at most
+	// labelsLookupTimeout
+	labelsLookupPoll    = 500 * time.Millisecond
+	labelsLookupTimeout = 30 * time.Second
+)
+
+// labelsMu serializes what the labels of the containers set up, e.g. the
+// backends of the load balancers, with the Leave of their endpoints
+var labelsMu sync.Mutex
+
+// containerLabels returns the labels of the container of an endpoint, nil
+// while Docker does not list it on the network
+func (d *Driver) containerLabels(networkID, endpointID string) (map[string]string, error) {
+	nw, err := d.dockerer.client.InspectNetwork(networkID)
+	if err != nil {
+		return nil, fmt.Errorf("could not inspect docker network [ %s ]: %s", networkID, err)
+	}
+	for id, c := range nw.Containers {
+		if c.EndpointID != endpointID {
+			continue
+		}
+		info, err := d.dockerer.client.InspectContainer(id)
+		if err != nil {
+			return nil, fmt.Errorf("could not inspect docker container [ %s ]: %s", id, err)
+		}
+		if info.Config == nil {
+			return map[string]string{}, nil
+		}
+		return info.Config.Labels, nil
+	}
+	return nil, nil
+}
+
+// joinLabels sets up what the labels of the container of a joined endpoint
+// ask for: the service it backs and its floating IP. Docker holds the
+// container while it joins, so it runs in the background once Join returned.
+func (d *Driver) joinLabels(r *request, ns *NetworkState, ep *EndpointState, endpointID string) {
+	if d.dockerer.client == nil {
+		return
+	}
+	sandboxKey := d.sandbox(ep)
+	go func() {
+		deadline := time.Now().Add(labelsLookupTimeout)
+		var labels map[string]string
+		for {
+			var err error
+			labels, err = d.containerLabels(ns.id, endpointID)
+			if err != nil {
+				r.log.Errorf("failed to look up the labels of endpoint [ %s ]: %s", endpointID, err)
+				return
+			}
+			if labels != nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				r.log.Warnf("docker does not list endpoint [ %s ] on network [ %s ], no labels looked up", endpointID, ns.id)
+				return
+			}
+			time.Sleep(labelsLookupPoll)
+		}
+
+		labelsMu.Lock()
+		defer labelsMu.Unlock()
+		// the endpoint left while its labels were looked up
+		if d.sandbox(ep) != sandboxKey {
+			return
+		}
+		if err := d.joinService(r, ns, ep, labels); err != nil {
+			r.log.Errorf("failed to add endpoint [ %s ] to its service: %s", endpointID, err)
+		}
+		// Join returned already, so the container runs without it
+		if err := d.joinFloatingIP(r, ns, ep, labels); err != nil {
+			r.log.Warnf("endpoint [ %s ] runs without the floating IP [ %s ] of its container label: %s", endpointID, labels[floatingIPOption], err)
+		}
+	}()
+}
+
+// leaveLabels marks an endpoint as leaving, so that the lookup of its labels
+// sets nothing up anymore, and removes it from its service
+func (d *Driver) leaveLabels(r *request, ns *NetworkState, ep *EndpointState) error {
+	labelsMu.Lock()
+	defer labelsMu.Unlock()
+	d.releaseSandbox(ep)
+	return d.leaveService(r, ns, ep)
+}
@@ -0,0 +1,130 @@
+package ovn
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/socketplane/libovsdb"
+)
+
+// resolveMu serializes the resolution of pending networks, so that the
+// concurrent endpoints of a network agree on its switch
+var resolveMu sync.Mutex
+
+// resolveNetwork gives a network pending in local scope its logical switch,
+// once Docker knows its name: the switch of the network of the same name on
+// another host if there is one, else a new one named after the network. It
+// returns the resolved state, which replaces the one of the networks map.
+func (d *Driver) resolveNetwork(r *request, ns *NetworkState) (*NetworkState, error) {
+	resolveMu.Lock()
+	defer resolveMu.Unlock()
+	// another endpoint may have resolved it since ns was read
+	if current, ok := d.network(ns.id); ok {
+		ns = current
+	}
+	if !ns.pending {
+		return ns, nil
+	}
+
+	nw, err := d.dockerer.client.InspectNetwork(ns.id)
+	if err != nil {
+		return nil, fmt.Errorf("could not inspect docker network [ %s ]: %s", ns.id, err)
+	}
+	resolved := *ns
+	resolved.Name = nw.Name
+	// another host may create the switch of the name at the same time
+	if err := retryConflict(r, "switch of network "+resolved.Name, func() error {
+		return d.tryResolveNetwork(r, &resolved)
+	}); err != nil {
+		return nil, err
+	}
+	resolved.pending = false
+	d.setNetwork(&resolved)
+	return &resolved, nil
+}
+
+func (d *Driver) tryResolveNetwork(r *request, ns *NetworkState) error {
+	switchName, err := d.ovnnber.namedSwitch(ns.Name)
+	if err != nil {
+		return err
+	}
+	if switchName != "" {
+		if err := d.ovnnber.checkTenant("Logical_Switch", switchName, ns.Tenant); err != nil {
+			return err
+		}
+		ns.BridgeName = switchName
+		r.log.Infof("Joined logical bridge [ %s ] of network [ %s ]", switchName, ns.Name)
+		return nil
+	}
+
+	// a switch named by the bridge name option keeps its name
+	if ns.BridgeName == config.BridgePrefix+truncateID(ns.id) {
+		ns.BridgeName = config.BridgePrefix + ns.Name
+	}
+	if err := d.ovnnber.claimSwitch(r, ns); err != nil {
+		return err
+	}
+	if err := d.initNetwork(r, ns); err != nil {
+		return err
+	}
+	r.log.Infof("Created logical bridge [ %s ] for network [ %s ]", ns.BridgeName, ns.Name)
+	return nil
+}
+
+// claimSwitch gives the switch of a network its net-name, creating it if it
+// does not exist, unless another host did so for the name since namedSwitch
+// found none. Logical_Switch.name is not unique and libovsdb omits the empty
+// rows of a wait, so the wait fails when the switches of the name are the
+// one the network would have rather than when there is any.
+func (ovnnber *ovnnber) claimSwitch(r *request, ns *NetworkState) error {
+	nameMap, _ := libovsdb.NewOvsMap(map[string]string{netNameKey: ns.Name})
+	waitOp := libovsdb.Operation{
+		Op:      "wait",
+		Table:   "Logical_Switch",
+		Where:   []interface{}{libovsdb.NewCondition("external_ids", "includes", nameMap)},
+		Columns: []string{"name"},
+		Until:   "!=",
+		Rows:    []map[string]interface{}{{"name": ns.BridgeName}},
+		Timeout: waitTimeout,
+	}
+
+	exists, err := ovnnber.bridgeExists(ns.BridgeName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		mutateOp := libovsdb.Operation{
+			Op:        "mutate",
+			Table:     "Logical_Switch",
+			Mutations: []interface{}{libovsdb.NewMutation("external_ids", "insert", nameMap)},
+			Where:     []interface{}{libovsdb.NewCondition("name", "==", ns.BridgeName)},
+		}
+		return ovnnber.transactWait(r, waitOp, mutateOp)
+	}
+
+	externalIDs := tenantExternalIDs(ns.Tenant)
+	externalIDs[netIDKey] = ns.id
+	externalIDs[netNameKey] = ns.Name
+	externalIDsMap, _ := libovsdb.NewOvsMap(externalIDs)
+	insertOp := libovsdb.Operation{
+		Op:    "insert",
+		Table: "Logical_Switch",
+		Row: map[string]interface{}{
+			"name":         ns.BridgeName,
+			"external_ids": externalIDsMap,
+		},
+	}
+	return ovnnber.transactWait(r, waitOp, insertOp)
+}
+
+// namedSwitch returns the name of the logical switch of the networks named
+// name in local scope, if any
+func (ovnnber *ovnnber) namedSwitch(name string) (string, error) {
+	nameMap, _ := libovsdb.NewOvsMap(map[string]string{netNameKey: name})
+	rows, err := ovnnber.selectRows("Logical_Switch", libovsdb.NewCondition("external_ids", "includes", nameMap))
+	if err != nil || len(rows) == 0 {
+		return "", err
+	}
+	switchName, _ := rows[0]["name"].(string)
+	return switchName, nil
+}
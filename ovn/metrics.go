@@ -0,0 +1,236 @@
+package ovn
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/socketplane/libovsdb"
+)
+
+const metricsNamespace = "ovn_plugin"
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "driver_requests_total",
+		Help:      "Docker network driver requests by method and result.",
+	}, []string{"method", "result"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "driver_request_duration_seconds",
+		Help:      "Latency of Docker network driver requests by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	transactionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ovsdb_transactions_total",
+		Help:      "OVSDB transactions by database, operations and result.",
+	}, []string{"database", "operations", "result"})
+
+	transactionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "ovsdb_transaction_duration_seconds",
+		Help:      "Latency of OVSDB transactions by database and operations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"database", "operations"})
+
+	reconnectsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ovsdb_reconnects_total",
+		Help:      "Reconnects to an OVSDB database after the connection was lost or replaced.",
+	}, []string{"database"})
+
+	nbCacheRowsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "nb_cache_rows"),
+		"Rows in the OVN Northbound cache by table.",
+		[]string{"table"}, nil)
+
+	networksDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "networks"),
+		"Networks tracked by the driver.",
+		nil, nil)
+
+	endpointsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "endpoints"),
+		"Endpoints tracked by the driver.",
+		nil, nil)
+)
+
+// RegisterMetrics registers the plugin metrics, including the state of d,
+// with the default prometheus registry
+func RegisterMetrics(d *Driver) {
+	prometheus.MustRegister(
+		requestsTotal,
+		requestDuration,
+		transactionsTotal,
+		transactionDuration,
+		reconnectsTotal,
+		&stateCollector{d: d},
+	)
+}
+
+// stateCollector reports the size of the northbound cache and of the
+// driver's network and endpoint maps at scrape time
+type stateCollector struct {
+	d *Driver
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- nbCacheRowsDesc
+	ch <- networksDesc
+	ch <- endpointsDesc
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	cacheMu.RLock()
+	for table, rows := range ovnnbCache {
+		ch <- prometheus.MustNewConstMetric(nbCacheRowsDesc, prometheus.GaugeValue, float64(len(rows)), table)
+	}
+	cacheMu.RUnlock()
+
+	c.d.netmu.RLock()
+	networks := len(c.d.networks)
+	c.d.netmu.RUnlock()
+	ch <- prometheus.MustNewConstMetric(networksDesc, prometheus.GaugeValue, float64(networks))
+
+	c.d.epmu.RLock()
+	endpoints := len(c.d.endpoints)
+	c.d.epmu.RUnlock()
+	ch <- prometheus.MustNewConstMetric(endpointsDesc, prometheus.GaugeValue, float64(endpoints))
+}
+
+func resultLabel(failed bool) string {
+	if failed {
+		return "error"
+	}
+	return "success"
+}
+
+// transact runs an OVSDB transaction and records its latency and result.
+// Transactions that change the database are audited for r, which is nil
+// for the plugin's own reads.
+func transact(r *request, client *libovsdb.OvsdbClient, database string, operations ...libovsdb.Operation) ([]libovsdb.OperationResult, error) {
+	var ops []string
+	readOnly := true
+	for _, o := range operations {
+		if len(ops) == 0 || ops[len(ops)-1] != o.Op {
+			ops = append(ops, o.Op)
+		}
+		if o.Op != "select" {
+			readOnly = false
+		}
+	}
+	opsLabel := strings.Join(ops, ",")
+
+	start := time.Now()
+	reply, err := client.Transact(database, operations...)
+	transactionDuration.WithLabelValues(database, opsLabel).Observe(time.Since(start).Seconds())
+
+	failure := err
+	if failure == nil && len(reply) < len(operations) {
+		failure = errors.New("Number of Replies should be at least equal to number of Operations")
+	}
+	for _, o := range reply {
+		if failure == nil && o.Error != "" {
+			failure = errors.New("Transaction Failed due to an error :" + o.Error + " details : " + o.Details)
+		}
+	}
+	transactionsTotal.WithLabelValues(database, opsLabel, resultLabel(failure != nil)).Inc()
+
+	if r != nil && !readOnly {
+		r.auditTransaction(database, operations, failure)
+	}
+	return reply, err
+}
+
+func observeRequest(method string, start time.Time, err *error) {
+	requestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	requestsTotal.WithLabelValues(method, resultLabel(*err != nil)).Inc()
+}
+
+// instrumentedDriver records the latency and result of every request
+// served by the wrapped driver
+type instrumentedDriver struct {
+	d network.Driver
+}
+
+// Instrument wraps a network driver so that its requests are recorded in
+// the plugin metrics
+func Instrument(d network.Driver) network.Driver {
+	return &instrumentedDriver{d: d}
+}
+
+func (i *instrumentedDriver) GetCapabilities() (res *network.CapabilitiesResponse, err error) {
+	defer observeRequest("GetCapabilities", time.Now(), &err)
+	return i.d.GetCapabilities()
+}
+
+func (i *instrumentedDriver) CreateNetwork(req *network.CreateNetworkRequest) (err error) {
+	defer observeRequest("CreateNetwork", time.Now(), &err)
+	return i.d.CreateNetwork(req)
+}
+
+func (i *instrumentedDriver) AllocateNetwork(req *network.AllocateNetworkRequest) (res *network.AllocateNetworkResponse, err error) {
+	defer observeRequest("AllocateNetwork", time.Now(), &err)
+	return i.d.AllocateNetwork(req)
+}
+
+func (i *instrumentedDriver) DeleteNetwork(req *network.DeleteNetworkRequest) (err error) {
+	defer observeRequest("DeleteNetwork", time.Now(), &err)
+	return i.d.DeleteNetwork(req)
+}
+
+func (i *instrumentedDriver) FreeNetwork(req *network.FreeNetworkRequest) (err error) {
+	defer observeRequest("FreeNetwork", time.Now(), &err)
+	return i.d.FreeNetwork(req)
+}
+
+func (i *instrumentedDriver) CreateEndpoint(req *network.CreateEndpointRequest) (res *network.CreateEndpointResponse, err error) {
+	defer observeRequest("CreateEndpoint", time.Now(), &err)
+	return i.d.CreateEndpoint(req)
+}
+
+func (i *instrumentedDriver) DeleteEndpoint(req *network.DeleteEndpointRequest) (err error) {
+	defer observeRequest("DeleteEndpoint", time.Now(), &err)
+	return i.d.DeleteEndpoint(req)
+}
+
+func (i *instrumentedDriver) EndpointInfo(req *network.InfoRequest) (res *network.InfoResponse, err error) {
+	defer observeRequest("EndpointInfo", time.Now(), &err)
+	return i.d.EndpointInfo(req)
+}
+
+func (i *instrumentedDriver) Join(req *network.JoinRequest) (res *network.JoinResponse, err error) {
+	defer observeRequest("Join", time.Now(), &err)
+	return i.d.Join(req)
+}
+
+func (i *instrumentedDriver) Leave(req *network.LeaveRequest) (err error) {
+	defer observeRequest("Leave", time.Now(), &err)
+	return i.d.Leave(req)
+}
+
+func (i *instrumentedDriver) DiscoverNew(notif *network.DiscoveryNotification) (err error) {
+	defer observeRequest("DiscoverNew", time.Now(), &err)
+	return i.d.DiscoverNew(notif)
+}
+
+func (i *instrumentedDriver) DiscoverDelete(notif *network.DiscoveryNotification) (err error) {
+	defer observeRequest("DiscoverDelete", time.Now(), &err)
+	return i.d.DiscoverDelete(notif)
+}
+
+func (i *instrumentedDriver) ProgramExternalConnectivity(req *network.ProgramExternalConnectivityRequest) (err error) {
+	defer observeRequest("ProgramExternalConnectivity", time.Now(), &err)
+	return i.d.ProgramExternalConnectivity(req)
+}
+
+func (i *instrumentedDriver) RevokeExternalConnectivity(req *network.RevokeExternalConnectivityRequest) (err error) {
+	defer observeRequest("RevokeExternalConnectivity", time.Now(), &err)
+	return i.d.RevokeExternalConnectivity(req)
+}
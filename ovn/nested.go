@@ -0,0 +1,131 @@
+package ovn
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/docker/libnetwork/ns"
+	"github.com/socketplane/libovsdb"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// the tags of the container ports of a VM are the VLANs of their
+	// subinterfaces on the VM's NIC, which cannot use the reserved 4095
+	minTag = minVLAN
+	maxTag = maxVLAN
+)
+
+// tagMu serializes the allocation of tags and the creation of the ports
+// holding them, as the tags of a parent port must be unique
+var tagMu sync.Mutex
+
+// nested tells whether the plugin runs in a VM whose own VIF is the OVN
+// logical port config.NestedParentPort. The container ports are then its
+// children and reach it tagged, through VLAN subinterfaces of
+// config.NestedInterface, without a local OVS or ovn-controller.
+func nested() bool {
+	return config.NestedParentPort != ""
+}
+
+// allocateTag returns the lowest tag no child port of parentName has
+func (ovnnber *ovnnber) allocateTag(parentName string) (int, error) {
+	rows, err := ovnnber.selectRows("Logical_Switch_Port", libovsdb.NewCondition("parent_name", "==", parentName))
+	if err != nil {
+		return 0, err
+	}
+	used := make(map[int]bool)
+	for _, row := range rows {
+		if tag, ok := getRowInt(row, "tag"); ok {
+			used[tag] = true
+		}
+	}
+	for tag := minTag; tag <= maxTag; tag++ {
+		if !used[tag] {
+			return tag, nil
+		}
+	}
+	return 0, fmt.Errorf("no tag left for the child ports of [ %s ]", parentName)
+}
+
+// nestLogicalPort makes an existing logical port, e.g. one an address of the
+// OVN IPAM driver came with, a child of the VM's logical port
+func (ovnnber *ovnnber) nestLogicalPort(r *request, logicalPortName string) error {
+	tagMu.Lock()
+	defer tagMu.Unlock()
+	tag, err := ovnnber.allocateTag(config.NestedParentPort)
+	if err != nil {
+		return err
+	}
+	r.log.Infof("Nest logical port [ %s ] in [ %s ] with tag [ %d ]", logicalPortName, config.NestedParentPort, tag)
+
+	port := make(map[string]interface{})
+	port["parent_name"] = config.NestedParentPort
+	port["tag"] = tag
+	updateOp := libovsdb.Operation{
+		Op:    "update",
+		Table: "Logical_Switch_Port",
+		Row:   port,
+		Where: []interface{}{libovsdb.NewCondition("name", "==", logicalPortName)},
+	}
+	return ovnnber.transactOps(r, updateOp)
+}
+
+// logicalPortTag returns the tag of a child logical port
+func (ovnnber *ovnnber) logicalPortTag(logicalPortName string) (int, error) {
+	rows, err := ovnnber.selectRows("Logical_Switch_Port", libovsdb.NewCondition("name", "==", logicalPortName))
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, fmt.Errorf("failed to find logical port [ %s ]", logicalPortName)
+	}
+	tag, ok := getRowInt(rows[0], "tag")
+	if !ok {
+		return 0, fmt.Errorf("logical port [ %s ] has no tag", logicalPortName)
+	}
+	return tag, nil
+}
+
+// createVlanLink creates the VLAN subinterface name of the VM's NIC with the
+// container's MAC, as ip link add link PARENT name NAME type vlan id TAG does
+func createVlanLink(r *request, name, parentName, mac string, tag int) error {
+	r.log.Infof("Create VLAN [ %s ] on [ %s ] with tag [ %d ]", name, parentName, tag)
+
+	nlh := ns.NlHandle()
+	parent, err := nlh.LinkByName(parentName)
+	if err != nil {
+		return fmt.Errorf("failed to get link by name %s : %s", parentName, err.Error())
+	}
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return fmt.Errorf("failed to parse mac %s : %s", mac, err.Error())
+	}
+
+	vlan := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{Name: name, ParentIndex: parent.Attrs().Index, HardwareAddr: hwAddr},
+		VlanId:    tag,
+	}
+	err = nlh.LinkAdd(vlan)
+	r.auditLink(fmt.Sprintf("add vlan %d on %s", tag, parentName), name, err)
+	if err != nil {
+		return fmt.Errorf("error creating vlan link: %v", err)
+	}
+	return nil
+}
+
+// joinNested plugs the container into the child port of an endpoint
+// through a VLAN subinterface, which libnetwork moves into the container
+func (d *Driver) joinNested(r *request, ep *EndpointState, linkName string) error {
+	tag, err := d.ovnnber.logicalPortTag(ep.LogicalPortName)
+	if err != nil {
+		return err
+	}
+	if err := createVlanLink(r, linkName, config.NestedInterface, ep.mac, tag); err != nil {
+		return err
+	}
+	ep.vethOut = linkName
+	ep.vethIn = linkName
+	return nil
+}
@@ -6,6 +6,9 @@ import (
 	"os"
 	"os/signal"
 	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/socketplane/libovsdb"
@@ -15,13 +18,31 @@ var (
 	quit       chan bool
 	update     chan *libovsdb.TableUpdates
 	ovnnbCache map[string]map[string]libovsdb.Row
+	cacheMu    sync.RWMutex // guards ovnnbCache
+	exitHooks  []func()
+	exitMu     sync.Mutex // guards exitHooks
 )
 
+// AtExit registers f to run when the plugin is stopped by a signal
+func AtExit(f func()) {
+	exitMu.Lock()
+	exitHooks = append(exitHooks, f)
+	exitMu.Unlock()
+}
+
+func runExitHooks() {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	for _, f := range exitHooks {
+		f()
+	}
+}
+
 //  setupBridge If bridge does not exist create it.
-func (d *Driver) initBridge(id string) error {
-	bridgeName := d.networks[id].BridgeName
-	if err := d.ovnnber.addBridge(bridgeName, id); err != nil {
-		log.Errorf("error creating logical bridge [ %s ] : [ %s ]", bridgeName, err)
+func (d *Driver) initBridge(r *request, ns *NetworkState) error {
+	bridgeName := ns.BridgeName
+	if err := d.ovnnber.addBridge(r, bridgeName, ns.id, ns.Tenant); err != nil {
+		r.log.Errorf("error creating logical bridge [ %s ] : [ %s ]", bridgeName, err)
 		return err
 	}
 
@@ -36,7 +57,7 @@ func (ovnnber *ovnnber) bridgeExists(portName string) (bool, error) {
 		Where: []interface{}{condition},
 	}
 	operations := []libovsdb.Operation{selectOp}
-	reply, _ := ovnnber.ovsdb.Transact("OVN_Northbound", operations...)
+	reply, _ := transact(nil, ovnnber.client(), "OVN_Northbound", operations...)
 
 	if len(reply) < len(operations) {
 		return false, errors.New("Number of Replies should be atleast equal to number of Operations")
@@ -61,7 +82,7 @@ func (ovnnber *ovnnber) endpointpointExists(endpointName string) (bool, error) {
 		Where: []interface{}{condition},
 	}
 	operations := []libovsdb.Operation{selectOp}
-	reply, _ := ovnnber.ovsdb.Transact("OVN_Northbound", operations...)
+	reply, _ := transact(nil, ovnnber.client(), "OVN_Northbound", operations...)
 
 	if len(reply) < len(operations) {
 		return false, errors.New("Number of Replies should be atleast equal to number of Operations")
@@ -78,45 +99,57 @@ func (ovnnber *ovnnber) endpointpointExists(endpointName string) (bool, error) {
 	return true, nil
 }
 
-func (d *Driver) addVethPort(bridgeName, vethOut, mac, portName, cnid string) error {
-	if err := d.ovsdber.addOvsVethPort(bridgeName, vethOut, mac); err != nil {
-		log.Errorf("error add ovs veth port [ %s %s ] on bridge [ %s ]", vethOut, mac, bridgeName)
+func (d *Driver) addVethPort(r *request, bridgeName, vethOut, mac, portName, cnid string) error {
+	if err := d.ovsdber.addOvsVethPort(r, bridgeName, vethOut, mac); err != nil {
+		r.log.Errorf("error add ovs veth port [ %s %s ] on bridge [ %s ]", vethOut, mac, bridgeName)
 		return err
 	}
 
-	if err := d.ovsdber.bindVeth(vethOut, mac, portName, cnid); err != nil {
-		log.Errorf("error bind veth [ %s %s ] eid [ %s ] on bridge [ %s ]", vethOut, mac, portName, bridgeName)
+	if err := d.ovsdber.bindVeth(r, vethOut, mac, portName, cnid); err != nil {
+		r.log.Errorf("error bind veth [ %s %s ] eid [ %s ] on bridge [ %s ]", vethOut, mac, portName, bridgeName)
 		return err
 	}
 	return nil
 }
 
-func (d *Driver) createEndpoint(bridgeName, endpointName string) error {
-	if err := d.ovnnber.addLogicalPort(bridgeName, endpointName); err != nil {
-		log.Errorf("error creating logical port [ %s ] on bridge [ %s ] : [ %s ]", endpointName, bridgeName, err)
+func (d *Driver) createEndpoint(r *request, bridgeName, endpointName string) error {
+	// in nested mode the port is a child of the VM's port with its own tag
+	var parentName string
+	var tag int
+	if nested() {
+		tagMu.Lock()
+		defer tagMu.Unlock()
+		parentName = config.NestedParentPort
+		var err error
+		if tag, err = d.ovnnber.allocateTag(parentName); err != nil {
+			return err
+		}
+	}
+	if err := d.ovnnber.addLogicalPort(r, bridgeName, endpointName, parentName, tag); err != nil {
+		r.log.Errorf("error creating logical port [ %s ] on bridge [ %s ] : [ %s ]", endpointName, bridgeName, err)
 		return err
 	}
 	return nil
 }
 
-func (d *Driver) deleteEndpoint(bridgeName, logicalPortName string) error {
-	if err := d.ovnnber.delLogicalPort(bridgeName, logicalPortName); err != nil {
-		log.Errorf("error deleting logical port [ %s ] on bridge [ %s ] : [ %s ]", logicalPortName, bridgeName, err)
+func (d *Driver) deleteEndpoint(r *request, bridgeName, logicalPortName string) error {
+	if err := d.ovnnber.delLogicalPort(r, bridgeName, logicalPortName); err != nil {
+		r.log.Errorf("error deleting logical port [ %s ] on bridge [ %s ] : [ %s ]", logicalPortName, bridgeName, err)
 		return err
 	}
 	return nil
 }
 
-func (d *Driver) setEndpointAddr(logicalPortName, ipaddr, macaddr string) error {
-	if err := d.ovnnber.setLogicalPortAddr(logicalPortName, ipaddr, macaddr); err != nil {
-		log.Errorf("error set logical port [ %s ] to [ %s ] : [ %s ]", logicalPortName, ipaddr, macaddr)
+func (d *Driver) setEndpointAddr(r *request, logicalPortName, ipaddr, macaddr string) error {
+	if err := d.ovnnber.setLogicalPortAddr(r, logicalPortName, ipaddr, macaddr); err != nil {
+		r.log.Errorf("error set logical port [ %s ] to [ %s ] : [ %s ]", logicalPortName, ipaddr, macaddr)
 		return err
 	}
 	return nil
 }
 
 // createOvsdbBridge creates the OVS bridge
-func (ovnnber *ovnnber) createLogicalBridge(bridgeName, netid string) error {
+func (ovnnber *ovnnber) createLogicalBridge(r *request, bridgeName, netid, tenant string) error {
 	namedBridgeUUID := "bridge"
 
 	// Bridge row to insert
@@ -130,9 +163,14 @@ func (ovnnber *ovnnber) createLogicalBridge(bridgeName, netid string) error {
 		UUIDName: namedBridgeUUID,
 	}
 
-	// Set the net-id of the logical switch to netid
+	// Set the net-id of the logical switch to netid, if any, and its tenant
 	gomap := make(map[interface{}]interface{})
-	gomap["net-id"] = netid
+	if netid != "" {
+		gomap["net-id"] = netid
+	}
+	if tenant != "" {
+		gomap[tenantKey] = tenant
+	}
 	mutateMap, _ := libovsdb.NewOvsMap(gomap)
 	mutation := libovsdb.NewMutation("external_ids", "insert", mutateMap)
 	condition := libovsdb.NewCondition("name", "==", bridgeName)
@@ -145,7 +183,7 @@ func (ovnnber *ovnnber) createLogicalBridge(bridgeName, netid string) error {
 	}
 
 	operations := []libovsdb.Operation{insertBridgeOp, mutateOp}
-	reply, _ := ovnnber.ovsdb.Transact("OVN_Northbound", operations...)
+	reply, _ := transact(r, ovnnber.client(), "OVN_Northbound", operations...)
 
 	if len(reply) < len(operations) {
 		return errors.New("Number of Replies should be atleast equal to number of Operations")
@@ -158,14 +196,14 @@ func (ovnnber *ovnnber) createLogicalBridge(bridgeName, netid string) error {
 		}
 	}
 
-	log.Debugf("Created OVN logical bridge [ %s ]", bridgeName)
+	r.log.Debugf("Created OVN logical bridge [ %s ]", bridgeName)
 	return nil
 }
 
 // Check if port exists prior to creating a bridge
-func (ovnnber *ovnnber) addBridge(bridgeName, netid string) error {
-	log.Debugf("Create OVN logical bridge [ %s ]", bridgeName)
-	if ovnnber.ovsdb == nil {
+func (ovnnber *ovnnber) addBridge(r *request, bridgeName, netid, tenant string) error {
+	r.log.Debugf("Create OVN logical bridge [ %s ]", bridgeName)
+	if ovnnber.client() == nil {
 		return errors.New("OVS not connected")
 	}
 	// If the bridge has been created, an internal port with the same name will exist
@@ -174,7 +212,7 @@ func (ovnnber *ovnnber) addBridge(bridgeName, netid string) error {
 		return err
 	}
 	if !exists {
-		if err := ovnnber.createLogicalBridge(bridgeName, netid); err != nil {
+		if err := ovnnber.createLogicalBridge(r, bridgeName, netid, tenant); err != nil {
 			return err
 		}
 		exists, err = ovnnber.bridgeExists(bridgeName)
@@ -188,8 +226,8 @@ func (ovnnber *ovnnber) addBridge(bridgeName, netid string) error {
 	return nil
 }
 
-func (ovnnber *ovnnber) delLogicalPort(switchName, logicalPortName string) error {
-	log.Infof("ovnnber deleting port [ %s ] on switch [ %s ]", logicalPortName, switchName)
+func (ovnnber *ovnnber) delLogicalPort(r *request, switchName, logicalPortName string) error {
+	r.log.Infof("ovnnber deleting port [ %s ] on switch [ %s ]", logicalPortName, switchName)
 
 	// Achieve in two transactions:
 	// 1. find the UUID of the logicalport in the Logical_Switch_Port table
@@ -205,7 +243,7 @@ func (ovnnber *ovnnber) delLogicalPort(switchName, logicalPortName string) error
 	}
 
 	operations := []libovsdb.Operation{selectOp}
-	reply, _ := ovnnber.ovsdb.Transact("OVN_Northbound", operations...)
+	reply, _ := transact(r, ovnnber.client(), "OVN_Northbound", operations...)
 
 	if len(reply) < len(operations) {
 		return errors.New("Number of Replies should be at least equal to number of Operations")
@@ -236,10 +274,10 @@ func (ovnnber *ovnnber) delLogicalPort(switchName, logicalPortName string) error
 	}
 
 	operations = []libovsdb.Operation{mutateOp}
-	reply, _ = ovnnber.ovsdb.Transact("OVN_Northbound", operations...)
+	reply, _ = transact(r, ovnnber.client(), "OVN_Northbound", operations...)
 
 	if len(reply) < len(operations) {
-		log.Infof("uuid: %v", reply)
+		r.log.Infof("uuid: %v", reply)
 		return errors.New("Number of Replies should be at least equal to number of Operations")
 	}
 
@@ -250,23 +288,28 @@ func (ovnnber *ovnnber) delLogicalPort(switchName, logicalPortName string) error
 	return nil
 }
 
-func (ovnnber *ovnnber) setLogicalPortAddr(logicalPortName, ipaddr, macaddr string) error {
+func (ovnnber *ovnnber) setLogicalPortAddr(r *request, logicalPortName, ipaddr, macaddr string) error {
 	ipmac := macaddr + " " + ipaddr
 	mutateAddr := []string{ipmac}
 	mutateSet, _ := libovsdb.NewOvsSet(mutateAddr)
 	mutation := libovsdb.NewMutation("addresses", "insert", mutateSet)
 	condition := libovsdb.NewCondition("name", "==", logicalPortName)
+	mutations := []interface{}{mutation}
+
+	if m := portSecurityMutation(ipaddr, macaddr); m != nil {
+		mutations = append(mutations, m)
+	}
 
 	// Mutate operation
 	mutateOp := libovsdb.Operation{
 		Op:        "mutate",
 		Table:     "Logical_Switch_Port",
-		Mutations: []interface{}{mutation},
+		Mutations: mutations,
 		Where:     []interface{}{condition},
 	}
 
 	operations := []libovsdb.Operation{mutateOp}
-	reply, _ := ovnnber.ovsdb.Transact("OVN_Northbound", operations...)
+	reply, _ := transact(r, ovnnber.client(), "OVN_Northbound", operations...)
 
 	if len(reply) < len(operations) {
 		return errors.New("Number of Replies should be at least equal to number of Operations")
@@ -282,9 +325,27 @@ func (ovnnber *ovnnber) setLogicalPortAddr(logicalPortName, ipaddr, macaddr stri
 	return nil
 }
 
-// Check if port exists prior to creating a bridge
-func (ovnnber *ovnnber) addLogicalPort(switchName, logicalPortName string) error {
-	log.Infof("addlogicalPort [ %s ] to switch [ %s ]", logicalPortName, switchName)
+// portSecurityMutation restricts the traffic of a port as the port security
+// policy says, or returns nil when there is none
+func portSecurityMutation(ipaddr, macaddr string) interface{} {
+	var portSecurity string
+	switch config.PortSecurity {
+	case portSecurityMAC:
+		portSecurity = macaddr
+	case portSecurityMACIP:
+		portSecurity = macaddr + " " + ipaddr
+	}
+	if portSecurity == "" {
+		return nil
+	}
+	securitySet, _ := libovsdb.NewOvsSet([]string{portSecurity})
+	return libovsdb.NewMutation("port_security", "insert", securitySet)
+}
+
+// Check if port exists prior to creating a bridge. A port with a parentName
+// is a child of that port, whose traffic it carries tagged with tag.
+func (ovnnber *ovnnber) addLogicalPort(r *request, switchName, logicalPortName, parentName string, tag int) error {
+	r.log.Infof("addlogicalPort [ %s ] to switch [ %s ]", logicalPortName, switchName)
 
 	namedEndpointUUID := "endpoint"
 
@@ -293,6 +354,10 @@ func (ovnnber *ovnnber) addLogicalPort(switchName, logicalPortName string) error
 	port["name"] = logicalPortName
 	port["type"] = ""
 	port["up"] = false
+	if parentName != "" {
+		port["parent_name"] = parentName
+		port["tag"] = tag
+	}
 
 	insertPortOp := libovsdb.Operation{
 		Op:       "insert",
@@ -318,7 +383,7 @@ func (ovnnber *ovnnber) addLogicalPort(switchName, logicalPortName string) error
 	}
 
 	operations := []libovsdb.Operation{insertPortOp, mutateOp}
-	reply, _ := ovnnber.ovsdb.Transact("OVN_Northbound", operations...)
+	reply, _ := transact(r, ovnnber.client(), "OVN_Northbound", operations...)
 
 	if len(reply) < len(operations) {
 		return errors.New("Number of Replies should be at least equal to number of Operations")
@@ -330,13 +395,14 @@ func (ovnnber *ovnnber) addLogicalPort(switchName, logicalPortName string) error
 			return errors.New("Transaction Failed due to an error :" + o.Error + " details : " + o.Details)
 		}
 	}
-	log.Debugf("Added logical port [ %s ] to logical switch [ %s ]", logicalPortName, switchName)
+	r.log.Debugf("Added logical port [ %s ] to logical switch [ %s ]", logicalPortName, switchName)
 
 	return nil
 }
 
 // OvnnbNotifier implements libovsdb.NotificationHandler interface
 type OvnnbNotifier struct {
+	nb *ovnnber
 }
 
 // Update Notification
@@ -347,6 +413,11 @@ func (o OvnnbNotifier) Update(context interface{}, tableUpdates libovsdb.TableUp
 
 // Disconnected notification
 func (o OvnnbNotifier) Disconnected(ovsClient *libovsdb.OvsdbClient) {
+	log.Errorf("Disconnected from OVN Northbound, failing over")
+	atomic.StoreInt32(&o.nb.connected, 0)
+	// libovsdb holds its connection lock while notifying, so reconnect
+	// asynchronously
+	go o.nb.failover(ovsClient)
 }
 
 //Locked Notification
@@ -361,38 +432,107 @@ func (o OvnnbNotifier) Stolen([]interface{}) {
 func (o OvnnbNotifier) Echo([]interface{}) {
 }
 
-func (ovnnber *ovnnber) initDBCache() {
+func (ovnnber *ovnnber) initDBCache() error {
 	quit = make(chan bool)
 	update = make(chan *libovsdb.TableUpdates)
 	ovnnbCache = make(map[string]map[string]libovsdb.Row)
 
-	// Register for ovsdb table notifications
-	var notifier OvnnbNotifier
-	ovnnber.ovsdb.Register(notifier)
-	// Populate ovnnb cache for the default OVN_Northbound db
-	initCache, err := ovnnber.ovsdb.MonitorAll("OVN_Northbound", "")
-	if err != nil {
-		log.Errorf("Error populating initial OVNNB cache: %s", err)
+	if err := ovnnber.monitor(ovnnber.client()); err != nil {
+		return err
 	}
 
-	populateCache(*initCache)
-
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Kill, os.Interrupt)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Kill, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		quit <- true
+		runExitHooks()
 		os.Exit(1)
 	}()
+
+	// SIGHUP re-establishes the northbound connection, which also reloads
+	// the ssl key and certificates from disk
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Infof("Reconnecting to OVN Northbound on SIGHUP")
+			if err := ovnnber.reconnect(); err != nil {
+				log.Errorf("Error reconnecting to OVN Northbound: %s", err)
+			}
+		}
+	}()
+
 	// async monitoring of the ovs bridge(s) for table updates
 	go ovnnber.monitorLogicalSwitches(quit)
+	// fail over when a clustered northbound member loses the leadership
+	go ovnnber.watchLeader(quit)
 	/*
 		for ovnnber.getRootUUID() == "" {
 			time.Sleep(time.Second * 1)
 		}*/
+	return nil
+}
+
+// monitor registers for OVN_Northbound table notifications on client and
+// populates the ovnnb cache with the initial table contents
+func (ovnnber *ovnnber) monitor(client *libovsdb.OvsdbClient) error {
+	notifier := OvnnbNotifier{nb: ovnnber}
+	client.Register(notifier)
+	initCache, err := client.MonitorAll("OVN_Northbound", "")
+	if err != nil {
+		client.Unregister(notifier)
+		return fmt.Errorf("Error populating initial OVNNB cache: %s", err)
+	}
+	populateCache(*initCache)
+	return nil
+}
+
+func (ovnnber *ovnnber) client() *libovsdb.OvsdbClient {
+	ovnnber.mu.RLock()
+	defer ovnnber.mu.RUnlock()
+	return ovnnber.ovsdb
+}
+
+// reconnect replaces the northbound connection with a new one to the
+// current leader and restarts the table monitor on it
+func (ovnnber *ovnnber) reconnect() error {
+	ovnnber.failoverMu.Lock()
+	defer ovnnber.failoverMu.Unlock()
+	return ovnnber.reconnectLocked()
+}
+
+func (ovnnber *ovnnber) reconnectLocked() error {
+	client, err := ovnnber.connectLeader()
+	if err != nil {
+		return err
+	}
+
+	cacheMu.Lock()
+	ovnnbCache = make(map[string]map[string]libovsdb.Row)
+	cacheMu.Unlock()
+	if err := ovnnber.monitor(client); err != nil {
+		client.Disconnect()
+		return err
+	}
+
+	ovnnber.mu.Lock()
+	old := ovnnber.ovsdb
+	ovnnber.ovsdb = client
+	ovnnber.mu.Unlock()
+	atomic.StoreInt32(&ovnnber.connected, 1)
+	reconnectsTotal.WithLabelValues("OVN_Northbound").Inc()
+
+	if old != nil {
+		old.Unregister(OvnnbNotifier{nb: ovnnber})
+		old.Disconnect()
+	}
+	return nil
 }
 
 func (ovnnber *ovnnber) monitorLogicalSwitches(done <-chan bool) {
+	atomic.StoreInt32(&ovnnber.monitoring, 1)
+	defer atomic.StoreInt32(&ovnnber.monitoring, 0)
 	for {
 		select {
 		case <-done:
@@ -404,23 +544,7 @@ func (ovnnber *ovnnber) monitorLogicalSwitches(done <-chan bool) {
 					for _, row := range tableUpdate.Rows {
 						empty := libovsdb.Row{}
 						if !reflect.DeepEqual(row.New, empty) {
-							oldRow := row.Old
-							newRow := row.New
-							if _, ok := oldRow.Fields["name"]; !ok {
-								name := newRow.Fields["name"].(string)
-								externalIds := newRow.Fields["external_ids"].(libovsdb.OvsMap)
-								netid := externalIds.GoMap["net-id"].(string)
-								d := ovnnber.driver
-								if _, ok := d.networks[netid]; !ok {
-									log.Debugf("  netid [ %s ] created remotely", netid)
-									d.netmu.Lock()
-									d.networks[netid] = &NetworkState{
-										id:         netid,
-										BridgeName: name,
-									}
-									d.netmu.Unlock()
-								}
-							}
+							ovnnber.learnNetwork(row.New)
 						}
 					}
 				}
@@ -429,7 +553,36 @@ func (ovnnber *ovnnber) monitorLogicalSwitches(done <-chan bool) {
 	}
 }
 
+// learnNetwork records the network of a logical switch inserted or updated
+// in the OVN Northbound, unless this host created it, so that Join on this
+// host knows its whole state. The switches of IPAM pools get their net-id
+// later. Most updates are ports added or deleted, which leave the recorded
+// state as it is and the map untouched.
+func (ovnnber *ovnnber) learnNetwork(row libovsdb.Row) {
+	name, _ := row.Fields["name"].(string)
+	externalIds, _ := row.Fields["external_ids"].(libovsdb.OvsMap)
+	ns := networkStateFromExternalIDs(name, ovsMapStrings(externalIds))
+	if ns == nil {
+		return
+	}
+	ns.remote = true
+
+	d := ovnnber.driver
+	d.netmu.Lock()
+	defer d.netmu.Unlock()
+	known, ok := d.networks[ns.id]
+	if ok && (!known.remote || (known.BridgeName == ns.BridgeName && reflect.DeepEqual(known.externalIDs(), ns.externalIDs()))) {
+		return
+	}
+	if !ok {
+		log.Debugf("  netid [ %s ] created remotely", ns.id)
+	}
+	d.networks[ns.id] = ns
+}
+
 func (ovnnber *ovnnber) getRootUUID() string {
+	cacheMu.RLock()
+	defer cacheMu.RUnlock()
 	for uuid := range ovnnbCache["OVN_Northbound"] {
 		return uuid
 	}
@@ -437,6 +590,8 @@ func (ovnnber *ovnnber) getRootUUID() string {
 }
 
 func populateCache(updates libovsdb.TableUpdates) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
 	for table, tableUpdate := range updates.Updates {
 		if _, ok := ovnnbCache[table]; !ok {
 			ovnnbCache[table] = make(map[string]libovsdb.Row)
@@ -4,17 +4,216 @@ import (
 	"errors"
 	"fmt"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/socketplane/libovsdb"
 )
 
 const (
 	ovsdbPort = 6640
 	ovnNBPort = 6641
+	ovnSBPort = 6642
+
+	// DefaultOvsdbRemote is the default local Open_vSwitch database remote
+	DefaultOvsdbRemote = "unix:/var/run/openvswitch/db.sock"
+
+	// defaultIntegrationBridge is used when external_ids:ovn-bridge is unset
+	defaultIntegrationBridge = "br-int"
 )
 
-func (ovsdber *ovsdber) bindVeth(vethOut, mac, portName, cnid string) error {
-	log.Infof("bind veth [ %s %s ]", vethOut, portName)
+// getOpenvSwitchRow returns the single row of the Open_vSwitch table
+func (ovsdber *ovsdber) getOpenvSwitchRow() (map[string]interface{}, error) {
+	selectOp := libovsdb.Operation{
+		Op:    "select",
+		Table: "Open_vSwitch",
+	}
+	operations := []libovsdb.Operation{selectOp}
+	reply, err := transact(nil, ovsdber.ovsdb, "Open_vSwitch", operations...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(reply) < len(operations) {
+		return nil, errors.New("Number of Replies should be at least equal to number of Operations")
+	}
+
+	if reply[0].Error != "" {
+		return nil, errors.New("Transaction Failed due to an error :" + reply[0].Error + " details : " + reply[0].Details)
+	}
+
+	if len(reply[0].Rows) == 0 {
+		return nil, errors.New("Open_vSwitch table is empty")
+	}
+	return reply[0].Rows[0], nil
+}
+
+// getExternalIDs returns the external_ids of the Open_vSwitch table row
+func (ovsdber *ovsdber) getExternalIDs() (map[string]string, error) {
+	row, err := ovsdber.getOpenvSwitchRow()
+	if err != nil {
+		return nil, err
+	}
+	return getRowMap(row, "external_ids"), nil
+}
+
+// getNBRemote returns the OVN Northbound remote(s) configured in the
+// external_ids:ovn-nb of the local Open_vSwitch table
+func (ovsdber *ovsdber) getNBRemote() (string, error) {
+	externalIDs, err := ovsdber.getExternalIDs()
+	if err != nil {
+		return "", err
+	}
+	return externalIDs["ovn-nb"], nil
+}
+
+// initIntegrationBridge sets ovsdber.bridge to the OVN integration bridge
+// named in external_ids:ovn-bridge, br-int by default, and creates the bridge
+// the way ovn-controller does if it does not exist yet
+func (ovsdber *ovsdber) initIntegrationBridge(r *request) error {
+	row, err := ovsdber.getOpenvSwitchRow()
+	if err != nil {
+		return err
+	}
+	externalIDs := getRowMap(row, "external_ids")
+
+	bridgeName := externalIDs["ovn-bridge"]
+	if bridgeName == "" {
+		bridgeName = defaultIntegrationBridge
+	}
+	ovsdber.bridge = bridgeName
+
+	exists, err := ovsdber.bridgeExists(bridgeName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		r.log.Debugf("Using OVN integration bridge [ %s ]", bridgeName)
+		return nil
+	}
+
+	datapathType := externalIDs["ovn-bridge-datapath-type"]
+	if err := ovsdber.createIntegrationBridge(r, getRowUUID(row), bridgeName, datapathType); err != nil {
+		r.log.Errorf("error creating OVN integration bridge [ %s ] : [ %s ]", bridgeName, err)
+		return err
+	}
+	r.log.Infof("Created OVN integration bridge [ %s ]", bridgeName)
+	return nil
+}
+
+func (ovsdber *ovsdber) bridgeExists(bridgeName string) (bool, error) {
+	condition := libovsdb.NewCondition("name", "==", bridgeName)
+	selectOp := libovsdb.Operation{
+		Op:      "select",
+		Table:   "Bridge",
+		Columns: []string{"name"},
+		Where:   []interface{}{condition},
+	}
+	operations := []libovsdb.Operation{selectOp}
+	reply, err := transact(nil, ovsdber.ovsdb, "Open_vSwitch", operations...)
+	if err != nil {
+		return false, err
+	}
+
+	if len(reply) < len(operations) {
+		return false, errors.New("Number of Replies should be at least equal to number of Operations")
+	}
+
+	if reply[0].Error != "" {
+		return false, errors.New("Transaction Failed due to an error :" + reply[0].Error + " details : " + reply[0].Details)
+	}
+
+	return len(reply[0].Rows) > 0, nil
+}
+
+// createIntegrationBridge adds a bridge with its internal port to the
+// Open_vSwitch row rootUUID, using the settings ovn-controller applies to
+// the integration bridge
+func (ovsdber *ovsdber) createIntegrationBridge(r *request, rootUUID, bridgeName, datapathType string) error {
+	namedIntfUUID := "intf"
+	namedPortUUID := "port"
+	namedBridgeUUID := "bridge"
+
+	// intf row to insert
+	intf := make(map[string]interface{})
+	intf["name"] = bridgeName
+	intf["type"] = "internal"
+
+	insertIntfOp := libovsdb.Operation{
+		Op:       "insert",
+		Table:    "Interface",
+		Row:      intf,
+		UUIDName: namedIntfUUID,
+	}
+
+	// port row to insert
+	port := make(map[string]interface{})
+	port["name"] = bridgeName
+	port["interfaces"] = libovsdb.UUID{
+		GoUUID: namedIntfUUID,
+	}
+
+	insertPortOp := libovsdb.Operation{
+		Op:       "insert",
+		Table:    "Port",
+		Row:      port,
+		UUIDName: namedPortUUID,
+	}
+
+	// bridge row to insert
+	otherConfig, _ := libovsdb.NewOvsMap(map[string]string{
+		"disable-in-band": "true",
+	})
+	bridge := make(map[string]interface{})
+	bridge["name"] = bridgeName
+	bridge["fail_mode"] = "secure"
+	bridge["other_config"] = otherConfig
+	bridge["ports"] = libovsdb.UUID{
+		GoUUID: namedPortUUID,
+	}
+	if datapathType != "" {
+		bridge["datapath_type"] = datapathType
+	}
+
+	insertBridgeOp := libovsdb.Operation{
+		Op:       "insert",
+		Table:    "Bridge",
+		Row:      bridge,
+		UUIDName: namedBridgeUUID,
+	}
+
+	// Inserting a row in Bridge table requires mutating the open_vswitch table.
+	mutateUUID := []libovsdb.UUID{
+		{GoUUID: namedBridgeUUID},
+	}
+	mutateSet, _ := libovsdb.NewOvsSet(mutateUUID)
+	mutation := libovsdb.NewMutation("bridges", "insert", mutateSet)
+	condition := libovsdb.NewCondition("_uuid", "==", libovsdb.UUID{GoUUID: rootUUID})
+
+	// Mutate operation
+	mutateOp := libovsdb.Operation{
+		Op:        "mutate",
+		Table:     "Open_vSwitch",
+		Mutations: []interface{}{mutation},
+		Where:     []interface{}{condition},
+	}
+
+	operations := []libovsdb.Operation{insertIntfOp, insertPortOp, insertBridgeOp, mutateOp}
+	reply, err := transact(r, ovsdber.ovsdb, "Open_vSwitch", operations...)
+	if err != nil {
+		return err
+	}
+
+	if len(reply) < len(operations) {
+		return errors.New("Number of Replies should be at least equal to number of Operations")
+	}
+	for _, o := range reply {
+		if o.Error != "" {
+			return errors.New("Transaction Failed due to an error :" + o.Error + " details : " + o.Details)
+		}
+	}
+	return nil
+}
+
+func (ovsdber *ovsdber) bindVeth(r *request, vethOut, mac, portName, cnid string) error {
+	r.log.Infof("bind veth [ %s %s ]", vethOut, portName)
 	// 2. ovs_vsctl("set", "interface", veth_outside,
 	//        "external_ids:attached-mac=" + mac_address,
 	//        "external_ids:iface-id=" + eid,
@@ -38,10 +237,10 @@ func (ovsdber *ovsdber) bindVeth(vethOut, mac, portName, cnid string) error {
 		Where:     []interface{}{condition},
 	}
 	operations := []libovsdb.Operation{mutateOp}
-	reply, _ := ovsdber.ovsdb.Transact("Open_vSwitch", operations...)
+	reply, _ := transact(r, ovsdber.ovsdb, "Open_vSwitch", operations...)
 
 	if len(reply) < len(operations) {
-		log.Error("Number of Replies should be atleast equal to number of Operations")
+		r.log.Error("Number of Replies should be atleast equal to number of Operations")
 	}
 	for i, o := range reply {
 		if o.Error != "" && i < len(operations) {
@@ -53,8 +252,8 @@ func (ovsdber *ovsdber) bindVeth(vethOut, mac, portName, cnid string) error {
 	return nil
 }
 
-func (ovsdber *ovsdber) deletePort(bridgeName string, portName string) error {
-	log.Infof("ovsdb deleting port [ %s ] on switch [ %s ]", portName, bridgeName)
+func (ovsdber *ovsdber) deletePort(r *request, bridgeName string, portName string) error {
+	r.log.Infof("ovsdb deleting port [ %s ] on switch [ %s ]", portName, bridgeName)
 
 	// Achieve in two transactions:
 	// 1. find the UUID of the port in the Port table
@@ -70,7 +269,7 @@ func (ovsdber *ovsdber) deletePort(bridgeName string, portName string) error {
 	}
 
 	operations := []libovsdb.Operation{selectOp}
-	reply, _ := ovsdber.ovsdb.Transact("Open_vSwitch", operations...)
+	reply, _ := transact(r, ovsdber.ovsdb, "Open_vSwitch", operations...)
 
 	if len(reply) < len(operations) {
 		return errors.New("Number of Replies should be at least equal to number of Operations")
@@ -84,7 +283,7 @@ func (ovsdber *ovsdber) deletePort(bridgeName string, portName string) error {
 	//     see the issue of libovsdb:
 	//     https://github.com/socketplane/libovsdb/issues/45
 	portUUID := getRowUUID(reply[0].Rows[0])
-	log.Infof("Port uuid %v", portUUID)
+	r.log.Infof("Port uuid %v", portUUID)
 
 	condition = libovsdb.NewCondition("name", "==", portName)
 	deleteOp := libovsdb.Operation{
@@ -96,7 +295,7 @@ func (ovsdber *ovsdber) deletePort(bridgeName string, portName string) error {
 	// fixmehk: Use ovsdb cache table
 	// portUUID = portUUIDForName(portName)
 	if portUUID == "" {
-		log.Error("Unable to find a matching Port : ", portName)
+		r.log.Error("Unable to find a matching Port : ", portName)
 		return fmt.Errorf("Unable to find a matching Port : [ %s ]", portName)
 	}
 
@@ -117,28 +316,28 @@ func (ovsdber *ovsdber) deletePort(bridgeName string, portName string) error {
 	}
 
 	operations = []libovsdb.Operation{deleteOp, mutateOp}
-	reply, _ = ovsdber.ovsdb.Transact("Open_vSwitch", operations...)
+	reply, _ = transact(r, ovsdber.ovsdb, "Open_vSwitch", operations...)
 
 	if len(reply) < len(operations) {
-		log.Error("Number of Replies should be atleast equal to number of Operations")
+		r.log.Error("Number of Replies should be atleast equal to number of Operations")
 		return fmt.Errorf("Number of Replies should be atleast equal to number of Operations")
 	}
 	for i, o := range reply {
 		if o.Error != "" && i < len(operations) {
-			log.Error("Transaction Failed due to an error :", o.Error, " in ", operations[i])
+			r.log.Error("Transaction Failed due to an error :", o.Error, " in ", operations[i])
 			return fmt.Errorf("Transaction Failed due to an error: %s in %v", o.Error, operations[i])
 		} else if o.Error != "" {
-			log.Error("Transaction Failed due to an error :", o.Error)
+			r.log.Error("Transaction Failed due to an error :", o.Error)
 			return fmt.Errorf("Transaction Failed due to an error %s", o.Error)
 		}
 	}
-	log.Infof("ovsdb deleted port %s", portName)
+	r.log.Infof("ovsdb deleted port %s", portName)
 	return nil
 }
 
-func (ovsdber *ovsdber) addOvsVethPort(bridgeName, vethOut, mac string) error {
+func (ovsdber *ovsdber) addOvsVethPort(r *request, bridgeName, vethOut, mac string) error {
 	// 1. ovs_vsctl("add-port", OVN_BRIDGE, veth_outside)
-	fmt.Printf("Added port [ %s ] to switch [  %s ]", vethOut, bridgeName)
+	r.log.Infof("Adding port [ %s ] to switch [ %s ]", vethOut, bridgeName)
 
 	namedPortUUID := "port"
 	namedIntfUUID := "intf"
@@ -184,12 +383,11 @@ func (ovsdber *ovsdber) addOvsVethPort(bridgeName, vethOut, mac string) error {
 		Where:     []interface{}{condition},
 	}
 	operations := []libovsdb.Operation{insertIntfOp, insertPortOp, mutateOp}
-	reply, _ := ovsdber.ovsdb.Transact("Open_vSwitch", operations...)
+	reply, _ := transact(r, ovsdber.ovsdb, "Open_vSwitch", operations...)
 
 	if len(reply) < len(operations) {
-		fmt.Println(len(reply))
-		fmt.Println(reply)
-		log.Error("Number of Replies should be atleast equal to number of Operations")
+		r.log.Debugf("%d replies: %v", len(reply), reply)
+		r.log.Error("Number of Replies should be atleast equal to number of Operations")
 	}
 	for i, o := range reply {
 		if o.Error != "" && i < len(operations) {
@@ -202,6 +400,27 @@ func (ovsdber *ovsdber) addOvsVethPort(bridgeName, vethOut, mac string) error {
 	return nil
 }
 
+// getRowMap extracts a string to string map column of the input row
+func getRowMap(columns map[string]interface{}, column string) map[string]string {
+	// map has fixed format: e.g., [map [[ovn-nb tcp:10.0.0.1:6641] [...]]]
+	m := make(map[string]string)
+	v, ok := columns[column].([]interface{})
+	if !ok || len(v) != 2 || v[0] != "map" {
+		return m
+	}
+	pairs, _ := v[1].([]interface{})
+	for _, p := range pairs {
+		kv, ok := p.([]interface{})
+		if !ok || len(kv) != 2 {
+			continue
+		}
+		k, _ := kv[0].(string)
+		val, _ := kv[1].(string)
+		m[k] = val
+	}
+	return m
+}
+
 // getRowUUID extracts the uuid of the input row
 func getRowUUID(columns map[string]interface{}) (uuid string) {
 	// uuid has fixed format: e.g., [uuid fdfb4bdd-08ee-453e-849e-8ef8d2116a82]
@@ -209,3 +428,142 @@ func getRowUUID(columns map[string]interface{}) (uuid string) {
 	k := u[1].(string)
 	return k
 }
+
+// getRowSet extracts a set of strings column of the input row, which holds
+// a single value as is
+func getRowSet(columns map[string]interface{}, column string) []string {
+	// set has fixed format: e.g., [set [a b]], or a for a single value
+	switch v := columns[column].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		if len(v) != 2 || v[0] != "set" {
+			return nil
+		}
+		values, _ := v[1].([]interface{})
+		var set []string
+		for _, value := range values {
+			if s, ok := value.(string); ok {
+				set = append(set, s)
+			}
+		}
+		return set
+	}
+	return nil
+}
+
+// getRowBool extracts an optional boolean column of the input row
+func getRowBool(columns map[string]interface{}, column string) (value, ok bool) {
+	value, ok = columns[column].(bool)
+	return value, ok
+}
+
+// getRowInt extracts an optional integer column of the input row
+func getRowInt(columns map[string]interface{}, column string) (value int, ok bool) {
+	// JSON numbers are decoded as float64
+	f, ok := columns[column].(float64)
+	return int(f), ok
+}
+
+// getRowRef extracts the uuid of an optional reference column of the input row
+func getRowRef(columns map[string]interface{}, column string) string {
+	// reference has fixed format: e.g., [uuid fdfb4bdd-...], or [set []] when empty
+	v, ok := columns[column].([]interface{})
+	if !ok || len(v) != 2 || v[0] != "uuid" {
+		return ""
+	}
+	uuid, _ := v[1].(string)
+	return uuid
+}
+
+// getRowRefs extracts the uuids of a set of references column of the input row
+func getRowRefs(columns map[string]interface{}, column string) []string {
+	// set has fixed format: e.g., [set [[uuid a] [uuid b]]], or [uuid a] for
+	// a single reference
+	v, ok := columns[column].([]interface{})
+	if !ok || len(v) != 2 {
+		return nil
+	}
+	if v[0] == "uuid" {
+		uuid, _ := v[1].(string)
+		return []string{uuid}
+	}
+	refs, _ := v[1].([]interface{})
+	var uuids []string
+	for _, ref := range refs {
+		if u, ok := ref.([]interface{}); ok && len(u) == 2 {
+			if uuid, ok := u[1].(string); ok {
+				uuids = append(uuids, uuid)
+			}
+		}
+	}
+	return uuids
+}
+
+// selectTable returns the rows of table in database matching all conditions
+func selectTable(client *libovsdb.OvsdbClient, database, table string, conditions ...interface{}) ([]map[string]interface{}, error) {
+	selectOp := libovsdb.Operation{
+		Op:    "select",
+		Table: table,
+		Where: conditions,
+	}
+	operations := []libovsdb.Operation{selectOp}
+	reply, err := transact(nil, client, database, operations...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(reply) < len(operations) {
+		return nil, errors.New("Number of Replies should be at least equal to number of Operations")
+	}
+	if reply[0].Error != "" {
+		return nil, errors.New("Transaction Failed due to an error :" + reply[0].Error + " details : " + reply[0].Details)
+	}
+	return reply[0].Rows, nil
+}
+
+// waitTimeout is the timeout of the wait operations in milliseconds. A wait
+// without one blocks until its condition holds, and libovsdb omits a zero.
+const waitTimeout = 1
+
+// conflictRetries bounds the retries of a change that another host made
+// concurrently
+const conflictRetries = 5
+
+// errConflict is returned when the wait starting a transaction fails, as the
+// rows it guards changed since they were read
+var errConflict = errors.New("the OVN Northbound changed concurrently")
+
+// transactWait runs operations starting with a wait in one northbound
+// transaction, and returns errConflict when the wait fails
+func (ovnnber *ovnnber) transactWait(r *request, operations ...libovsdb.Operation) error {
+	reply, err := transact(r, ovnnber.client(), "OVN_Northbound", operations...)
+	if err != nil {
+		return err
+	}
+	if len(reply) < len(operations) {
+		return errors.New("Number of Replies should be at least equal to number of Operations")
+	}
+	if reply[0].Error == "timed out" {
+		return errConflict
+	}
+	for _, o := range reply {
+		if o.Error != "" {
+			return errors.New("Transaction Failed due to an error :" + o.Error + " details : " + o.Details)
+		}
+	}
+	return nil
+}
+
+// retryConflict runs change again, on a fresh read of the rows, while another
+// host changes them concurrently
+func retryConflict(r *request, what string, change func() error) error {
+	var err error
+	for i := 0; i < conflictRetries; i++ {
+		if err = change(); err != errConflict {
+			return err
+		}
+		r.log.Debugf("The %s changed concurrently, retrying", what)
+	}
+	return err
+}
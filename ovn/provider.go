@@ -0,0 +1,272 @@
+package ovn
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/socketplane/libovsdb"
+)
+
+const (
+	// vlanOption puts a flat network on a VLAN of its physical network,
+	// from 1 to 4094; the network is untagged without it
+	vlanOption = "net.libnetwork.ovn.vlan"
+	// physicalNetworkOption names the physical network of a flat network,
+	// which ovn-bridge-mappings of every chassis maps to an OVS bridge
+	physicalNetworkOption = "net.libnetwork.ovn.physical_network"
+
+	minVLAN = 1
+	maxVLAN = 4094
+
+	// interface names are limited to 15 characters
+	maxLinkName = 15
+)
+
+// localnetPortName is the localnet logical switch port connecting the
+// logical switch of a flat network to its physical network
+func localnetPortName(switchName string) string {
+	return "provnet-" + switchName
+}
+
+// providerBridgeName is the OVS bridge the plugin creates for a physical
+// network that no bridge mapping names yet
+func providerBridgeName(physicalNetwork string) string {
+	name := "br-" + physicalNetwork
+	if len(name) > maxLinkName {
+		name = name[:maxLinkName]
+	}
+	return name
+}
+
+func getVLAN(r *network.CreateNetworkRequest) (int, error) {
+	if r.Options == nil {
+		return 0, nil
+	}
+	v, ok := r.Options[vlanOption].(string)
+	if !ok || v == "" {
+		return 0, nil
+	}
+	vlan, err := strconv.Atoi(v)
+	if err != nil || vlan < minVLAN || vlan > maxVLAN {
+		return 0, fmt.Errorf("%s is not a valid %s, it must be between %d and %d", v, vlanOption, minVLAN, maxVLAN)
+	}
+	return vlan, nil
+}
+
+func getPhysicalNetwork(r *network.CreateNetworkRequest) string {
+	if r.Options != nil {
+		if name, ok := r.Options[physicalNetworkOption].(string); ok && name != "" {
+			return name
+		}
+	}
+	return config.PhysicalNetwork
+}
+
+func vlanString(vlan int) string {
+	if vlan == 0 {
+		return "untagged"
+	}
+	return "VLAN " + strconv.Itoa(vlan)
+}
+
+// initProviderNetwork connects the logical switch of a flat network to its
+// physical network, on its VLAN if any, and maps the physical network to a
+// bridge with the bind interface on this host if no bridge mapping has it
+func (d *Driver) initProviderNetwork(r *request, ns *NetworkState) error {
+	if err := d.ovnnber.checkProviderVLAN(ns.PhysicalNetwork, ns.VLAN, ns.BridgeName); err != nil {
+		return err
+	}
+	if err := d.ovnnber.addLocalnetPort(r, ns.BridgeName, ns.PhysicalNetwork, ns.VLAN); err != nil {
+		return err
+	}
+	// a VM in nested mode has no OVS to map the physical network on
+	if ns.FlatBindInterface != "" && !nested() {
+		if err := d.ovsdber.ensureBridgeMapping(r, ns.PhysicalNetwork, ns.FlatBindInterface); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkProviderVLAN fails when another logical switch is already on the
+// same VLAN of the physical network, which would bridge the two switches
+func (ovnnber *ovnnber) checkProviderVLAN(physicalNetwork string, vlan int, switchName string) error {
+	options, _ := libovsdb.NewOvsMap(map[string]string{"network_name": physicalNetwork})
+	rows, err := selectTable(ovnnber.client(), "OVN_Northbound", "Logical_Switch_Port",
+		libovsdb.NewCondition("type", "==", "localnet"),
+		libovsdb.NewCondition("options", "includes", options))
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		name, _ := row["name"].(string)
+		if name == localnetPortName(switchName) {
+			continue
+		}
+		if tag, _ := getRowInt(row, "tag"); tag == vlan {
+			return fmt.Errorf("%s of physical network [ %s ] is already used by localnet port [ %s ]", vlanString(vlan), physicalNetwork, name)
+		}
+	}
+	return nil
+}
+
+// addLocalnetPort adds the localnet port of a logical switch, tagged with
+// the VLAN if any, as ovn-nbctl lsp-add SWITCH PORT "" VLAN and
+// lsp-set-type PORT localnet do
+func (ovnnber *ovnnber) addLocalnetPort(r *request, switchName, physicalNetwork string, vlan int) error {
+	portName := localnetPortName(switchName)
+	exists, err := ovnnber.endpointpointExists(portName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		r.log.Debugf("Localnet port [ %s ] exists", portName)
+		return nil
+	}
+	r.log.Infof("Connect logical switch [ %s ] to physical network [ %s ] %s", switchName, physicalNetwork, vlanString(vlan))
+
+	namedPortUUID := "localnet"
+	options, _ := libovsdb.NewOvsMap(map[string]string{"network_name": physicalNetwork})
+	port := make(map[string]interface{})
+	port["name"] = portName
+	port["type"] = "localnet"
+	port["addresses"] = "unknown"
+	port["options"] = options
+	if vlan != 0 {
+		port["tag"] = vlan
+	}
+
+	insertPortOp := libovsdb.Operation{
+		Op:       "insert",
+		Table:    "Logical_Switch_Port",
+		Row:      port,
+		UUIDName: namedPortUUID,
+	}
+
+	portSet, _ := libovsdb.NewOvsSet([]libovsdb.UUID{{GoUUID: namedPortUUID}})
+	mutateSwitchOp := libovsdb.Operation{
+		Op:        "mutate",
+		Table:     "Logical_Switch",
+		Mutations: []interface{}{libovsdb.NewMutation("ports", "insert", portSet)},
+		Where:     []interface{}{libovsdb.NewCondition("name", "==", switchName)},
+	}
+	return ovnnber.transactOps(r, insertPortOp, mutateSwitchOp)
+}
+
+// parseBridgeMappings parses ovn-bridge-mappings, e.g. physnet:br-eth1,
+// into physical networks and their bridges
+func parseBridgeMappings(mappings string) map[string]string {
+	m := make(map[string]string)
+	for _, mapping := range strings.Split(mappings, ",") {
+		parts := strings.SplitN(strings.TrimSpace(mapping), ":", 2)
+		if len(parts) == 2 && parts[0] != "" {
+			m[parts[0]] = parts[1]
+		}
+	}
+	return m
+}
+
+// ensureBridgeMapping maps the physical network to a bridge with the bind
+// interface in external_ids:ovn-bridge-mappings of the local Open_vSwitch,
+// creating the bridge, unless the physical network is mapped already.
+// Networks on different VLANs of one physical network share its mapping.
+func (ovsdber *ovsdber) ensureBridgeMapping(r *request, physicalNetwork, bindInterface string) error {
+	row, err := ovsdber.getOpenvSwitchRow()
+	if err != nil {
+		return err
+	}
+	mappings := getRowMap(row, "external_ids")["ovn-bridge-mappings"]
+	if bridgeName, ok := parseBridgeMappings(mappings)[physicalNetwork]; ok {
+		r.log.Debugf("Physical network [ %s ] is mapped to bridge [ %s ]", physicalNetwork, bridgeName)
+		return nil
+	}
+
+	bridgeName := providerBridgeName(physicalNetwork)
+	exists, err := ovsdber.bridgeExists(bridgeName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("bridge [ %s ] exists but physical network [ %s ] is not in ovn-bridge-mappings", bridgeName, physicalNetwork)
+	}
+	if mappings != "" {
+		mappings += ","
+	}
+	mappings += physicalNetwork + ":" + bridgeName
+
+	r.log.Infof("Map physical network [ %s ] to bridge [ %s ] with interface [ %s ]", physicalNetwork, bridgeName, bindInterface)
+	if err := ovsdber.createProviderBridge(r, getRowUUID(row), bridgeName, bindInterface, mappings); err != nil {
+		r.log.Errorf("error creating provider bridge [ %s ] : [ %s ]", bridgeName, err)
+		return err
+	}
+	return nil
+}
+
+// createProviderBridge adds a bridge with its internal port and the bind
+// interface to the Open_vSwitch row rootUUID and sets its
+// ovn-bridge-mappings to mappings, in one transaction
+func (ovsdber *ovsdber) createProviderBridge(r *request, rootUUID, bridgeName, bindInterface, mappings string) error {
+	var operations []libovsdb.Operation
+	var ports []libovsdb.UUID
+	for i, intfName := range []string{bridgeName, bindInterface} {
+		namedIntfUUID := fmt.Sprintf("intf%d", i)
+		namedPortUUID := fmt.Sprintf("port%d", i)
+
+		intf := make(map[string]interface{})
+		intf["name"] = intfName
+		if intfName == bridgeName {
+			intf["type"] = "internal"
+		}
+		port := make(map[string]interface{})
+		port["name"] = intfName
+		port["interfaces"] = libovsdb.UUID{GoUUID: namedIntfUUID}
+
+		operations = append(operations,
+			libovsdb.Operation{Op: "insert", Table: "Interface", Row: intf, UUIDName: namedIntfUUID},
+			libovsdb.Operation{Op: "insert", Table: "Port", Row: port, UUIDName: namedPortUUID})
+		ports = append(ports, libovsdb.UUID{GoUUID: namedPortUUID})
+	}
+
+	namedBridgeUUID := "bridge"
+	portSet, _ := libovsdb.NewOvsSet(ports)
+	bridge := make(map[string]interface{})
+	bridge["name"] = bridgeName
+	bridge["ports"] = portSet
+	operations = append(operations, libovsdb.Operation{
+		Op:       "insert",
+		Table:    "Bridge",
+		Row:      bridge,
+		UUIDName: namedBridgeUUID,
+	})
+
+	bridgeSet, _ := libovsdb.NewOvsSet([]libovsdb.UUID{{GoUUID: namedBridgeUUID}})
+	deleteSet, _ := libovsdb.NewOvsSet([]string{"ovn-bridge-mappings"})
+	insertMap, _ := libovsdb.NewOvsMap(map[string]string{"ovn-bridge-mappings": mappings})
+	operations = append(operations, libovsdb.Operation{
+		Op:    "mutate",
+		Table: "Open_vSwitch",
+		Mutations: []interface{}{
+			libovsdb.NewMutation("bridges", "insert", bridgeSet),
+			libovsdb.NewMutation("external_ids", "delete", deleteSet),
+			libovsdb.NewMutation("external_ids", "insert", insertMap),
+		},
+		Where: []interface{}{libovsdb.NewCondition("_uuid", "==", libovsdb.UUID{GoUUID: rootUUID})},
+	})
+
+	reply, err := transact(r, ovsdber.ovsdb, "Open_vSwitch", operations...)
+	if err != nil {
+		return err
+	}
+	if len(reply) < len(operations) {
+		return errors.New("Number of Replies should be at least equal to number of Operations")
+	}
+	for _, o := range reply {
+		if o.Error != "" {
+			return errors.New("Transaction Failed due to an error :" + o.Error + " details : " + o.Details)
+		}
+	}
+	return nil
+}
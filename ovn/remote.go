@@ -0,0 +1,226 @@
+package ovn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/socketplane/libovsdb"
+)
+
+const (
+	protoSSL  = "ssl"
+	protoTCP  = "tcp"
+	protoUnix = "unix"
+)
+
+// SSLConfig holds the files used to set up ssl: connections to OVSDB
+// servers. The files are read again every time a new connection is
+// established, so rotated certificates are picked up without a restart.
+type SSLConfig struct {
+	PrivateKey  string
+	Certificate string
+	CACert      string
+}
+
+// remote is a parsed OVSDB remote in OVN's "ssl:host:port", "tcp:host:port"
+// or "unix:/path" syntax
+type remote struct {
+	proto  string
+	target string
+}
+
+func (r remote) String() string {
+	return r.proto + ":" + r.target
+}
+
+// parseRemote parses an OVSDB remote string. A bare IP address is accepted
+// for backward compatibility and is treated as tcp on defaultPort, which is
+// also used when a tcp or ssl remote omits the port.
+func parseRemote(s string, defaultPort int) (remote, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return remote{}, fmt.Errorf("empty OVSDB remote")
+	}
+
+	if ip := net.ParseIP(s); ip != nil {
+		return remote{
+			proto:  protoTCP,
+			target: net.JoinHostPort(s, strconv.Itoa(defaultPort)),
+		}, nil
+	}
+
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return remote{}, fmt.Errorf("invalid OVSDB remote [ %s ]", s)
+	}
+	proto, rest := parts[0], parts[1]
+
+	switch proto {
+	case protoUnix:
+		return remote{proto: protoUnix, target: rest}, nil
+	case protoTCP, protoSSL:
+		host, port, err := net.SplitHostPort(rest)
+		if err != nil {
+			// the port is optional, e.g. "tcp:10.0.0.1" or "ssl:[::1]"
+			host = strings.TrimSuffix(strings.TrimPrefix(rest, "["), "]")
+			port = strconv.Itoa(defaultPort)
+		}
+		if host == "" {
+			return remote{}, fmt.Errorf("invalid OVSDB remote [ %s ]: missing host", s)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return remote{}, fmt.Errorf("invalid OVSDB remote [ %s ]: bad port [ %s ]", s, port)
+		}
+		return remote{proto: proto, target: net.JoinHostPort(host, port)}, nil
+	}
+	return remote{}, fmt.Errorf("invalid OVSDB remote [ %s ]: unsupported protocol [ %s ]", s, proto)
+}
+
+// connectRemote opens an OVSDB connection to the given remote
+func connectRemote(r remote, sslConfig *SSLConfig) (*libovsdb.OvsdbClient, error) {
+	switch r.proto {
+	case protoUnix:
+		return libovsdb.ConnectWithUnixSocket(r.target)
+	case protoTCP:
+		return libovsdb.ConnectUsingProtocol(protoTCP, r.target)
+	case protoSSL:
+		return connectSSL(r.target, sslConfig)
+	}
+	return nil, fmt.Errorf("unsupported OVSDB protocol [ %s ]", r.proto)
+}
+
+// connectSSL opens an ssl: OVSDB connection.
+//
+// libovsdb can only dial plain sockets itself, so the TLS session is
+// established here and handed to libovsdb through a private unix socket
+// that is removed as soon as the connection has been accepted.
+func connectSSL(target string, sslConfig *SSLConfig) (*libovsdb.OvsdbClient, error) {
+	tlsConfig, err := sslConfig.tlsConfig(target)
+	if err != nil {
+		return nil, err
+	}
+
+	upstream, err := tls.Dial("tcp", target, tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("ssl connection to [ %s ] failed: %s", target, err)
+	}
+
+	dir, err := ioutil.TempDir("", "ovn-plugin-ssl")
+	if err != nil {
+		upstream.Close()
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "ovsdb.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		upstream.Close()
+		return nil, err
+	}
+
+	accepted := make(chan error, 1)
+	go func() {
+		defer l.Close()
+		local, err := l.Accept()
+		if err != nil {
+			upstream.Close()
+			accepted <- err
+			return
+		}
+		accepted <- nil
+		go relay(local, upstream)
+	}()
+
+	client, err := libovsdb.ConnectWithUnixSocket(sock)
+	if err != nil {
+		l.Close()
+		upstream.Close()
+		return nil, err
+	}
+	if err := <-accepted; err != nil {
+		return nil, err
+	}
+	log.Debugf("Established ssl connection to OVSDB [ %s ]", target)
+	return client, nil
+}
+
+// relay copies data in both directions until either side closes
+func relay(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// tlsConfig loads the key, certificate and CA certificate from disk
+func (c *SSLConfig) tlsConfig(target string) (*tls.Config, error) {
+	if c == nil || c.PrivateKey == "" || c.Certificate == "" || c.CACert == "" {
+		return nil, fmt.Errorf("ssl remote [ %s ] requires a private key, certificate and CA certificate", target)
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.Certificate, c.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not load certificate [ %s ] and key [ %s ]: %s", c.Certificate, c.PrivateKey, err)
+	}
+
+	ca, err := ioutil.ReadFile(c.CACert)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA certificate [ %s ]: %s", c.CACert, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in CA certificate [ %s ]", c.CACert)
+	}
+
+	// Like ovsdb-server and ovn-controller, only require the peer certificate
+	// to be signed by the CA: OVN PKI certificates do not carry host names.
+	return &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPeer(rawCerts, pool)
+		},
+	}, nil
+}
+
+// verifyPeer checks the certificate chain presented by the server against
+// the CA certificate pool
+func verifyPeer(rawCerts [][]byte, pool *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("OVSDB server did not present a certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("could not parse OVSDB server certificate: %s", err)
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+	})
+	return err
+}
@@ -0,0 +1,145 @@
+package ovn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/socketplane/libovsdb"
+)
+
+// routerPortName is the name of the logical router port, and of its peer
+// logical switch port, connecting a logical switch to a router
+func routerPortName(switchName string) string {
+	return "rtr-" + switchName
+}
+
+func (ovnnber *ovnnber) routerExists(routerName string) (bool, error) {
+	condition := libovsdb.NewCondition("name", "==", routerName)
+	selectOp := libovsdb.Operation{
+		Op:    "select",
+		Table: "Logical_Router",
+		Where: []interface{}{condition},
+	}
+	operations := []libovsdb.Operation{selectOp}
+	reply, _ := transact(nil, ovnnber.client(), "OVN_Northbound", operations...)
+
+	if len(reply) < len(operations) {
+		return false, errors.New("Number of Replies should be at least equal to number of Operations")
+	}
+
+	if reply[0].Error != "" {
+		return false, errors.New("Transaction Failed due to an error :" + reply[0].Error + " details : " + reply[0].Details)
+	}
+
+	return len(reply[0].Rows) > 0, nil
+}
+
+// attachRouter connects the logical switch to the logical router, which is
+// created if it does not exist yet, with the gateway IP as the router address
+// on the switch. It is what ovn-nbctl lrp-add and lsp-add of a router port do.
+// The rows are tagged with the tenant, if any, and a router of another
+// tenant, or a subnet overlapping one already on the router, is refused.
+func (ovnnber *ovnnber) attachRouter(r *request, routerName, switchName, gateway, mask, tenant string) error {
+	r.log.Infof("Attach logical switch [ %s ] to router [ %s ] through [ %s/%s ]", switchName, routerName, gateway, mask)
+
+	gatewayIP := net.ParseIP(gateway)
+	if gatewayIP == nil {
+		return fmt.Errorf("invalid gateway IP [ %s ]", gateway)
+	}
+	_, subnet, err := net.ParseCIDR(gateway + "/" + mask)
+	if err != nil {
+		return fmt.Errorf("invalid gateway [ %s/%s ]", gateway, mask)
+	}
+
+	if err := ovnnber.checkTenant("Logical_Router", routerName, tenant); err != nil {
+		return err
+	}
+	if err := ovnnber.checkRouterSubnets(routerName, subnet); err != nil {
+		return err
+	}
+
+	exists, err := ovnnber.routerExists(routerName)
+	if err != nil {
+		return err
+	}
+
+	externalIDs, _ := libovsdb.NewOvsMap(tenantExternalIDs(tenant))
+
+	var operations []libovsdb.Operation
+	if !exists {
+		router := make(map[string]interface{})
+		router["name"] = routerName
+		router["external_ids"] = externalIDs
+		operations = append(operations, libovsdb.Operation{
+			Op:    "insert",
+			Table: "Logical_Router",
+			Row:   router,
+		})
+	}
+
+	portName := routerPortName(switchName)
+	namedRouterPortUUID := "routerport"
+	namedSwitchPortUUID := "switchport"
+
+	// Router side of the link
+	routerPort := make(map[string]interface{})
+	routerPort["name"] = portName
+	routerPort["mac"] = makeMac(gatewayIP)
+	routerPort["networks"] = gateway + "/" + mask
+	routerPort["external_ids"] = externalIDs
+
+	insertRouterPortOp := libovsdb.Operation{
+		Op:       "insert",
+		Table:    "Logical_Router_Port",
+		Row:      routerPort,
+		UUIDName: namedRouterPortUUID,
+	}
+
+	routerPortSet, _ := libovsdb.NewOvsSet([]libovsdb.UUID{{GoUUID: namedRouterPortUUID}})
+	mutateRouterOp := libovsdb.Operation{
+		Op:        "mutate",
+		Table:     "Logical_Router",
+		Mutations: []interface{}{libovsdb.NewMutation("ports", "insert", routerPortSet)},
+		Where:     []interface{}{libovsdb.NewCondition("name", "==", routerName)},
+	}
+
+	// Switch side of the link
+	options, _ := libovsdb.NewOvsMap(map[string]string{"router-port": portName})
+	switchPort := make(map[string]interface{})
+	switchPort["name"] = portName
+	switchPort["type"] = "router"
+	switchPort["addresses"] = "router"
+	switchPort["options"] = options
+	switchPort["external_ids"] = externalIDs
+
+	insertSwitchPortOp := libovsdb.Operation{
+		Op:       "insert",
+		Table:    "Logical_Switch_Port",
+		Row:      switchPort,
+		UUIDName: namedSwitchPortUUID,
+	}
+
+	switchPortSet, _ := libovsdb.NewOvsSet([]libovsdb.UUID{{GoUUID: namedSwitchPortUUID}})
+	mutateSwitchOp := libovsdb.Operation{
+		Op:        "mutate",
+		Table:     "Logical_Switch",
+		Mutations: []interface{}{libovsdb.NewMutation("ports", "insert", switchPortSet)},
+		Where:     []interface{}{libovsdb.NewCondition("name", "==", switchName)},
+	}
+
+	operations = append(operations, insertRouterPortOp, mutateRouterOp, insertSwitchPortOp, mutateSwitchOp)
+	reply, _ := transact(r, ovnnber.client(), "OVN_Northbound", operations...)
+
+	if len(reply) < len(operations) {
+		return errors.New("Number of Replies should be at least equal to number of Operations")
+	}
+	for _, o := range reply {
+		if o.Error != "" {
+			return errors.New("Transaction Failed due to an error :" + o.Error + " details : " + o.Details)
+		}
+	}
+
+	r.log.Debugf("Attached logical switch [ %s ] to router [ %s ]", switchName, routerName)
+	return nil
+}
@@ -0,0 +1,541 @@
+package ovn
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/socketplane/libovsdb"
+)
+
+const (
+	// serviceLabel names the service a container backs on each ovn network
+	// it joins. The containers of a service on a network are reachable
+	// through the virtual IP of serviceVIPLabel, load-balanced by OVN.
+	serviceLabel = "net.libnetwork.ovn.service"
+	// serviceVIPLabel is the virtual IP of the service, e.g. 10.0.0.100
+	serviceVIPLabel = "net.libnetwork.ovn.service.vip"
+	// servicePortsLabel lists the ports of the VIP, each forwarded to the
+	// same port of the backends or to another, e.g. 80,443:8443. Without
+	// ports the VIP forwards every port.
+	servicePortsLabel = "net.libnetwork.ovn.service.ports"
+	// serviceProtocolLabel is the protocol of the ports, tcp or udp
+	serviceProtocolLabel = "net.libnetwork.ovn.service.protocol"
+	// serviceHealthCheckLabel makes the OVN service monitor probe the ports
+	// of the backends and take the failing ones out of rotation, e.g.
+	// source_ip=10.0.0.254,interval=5,timeout=20,success_count=3,failure_count=3.
+	// source_ip, the address the probes come from, must be a free address
+	// of the subnet; the other options default to the ones of OVN.
+	serviceHealthCheckLabel = "net.libnetwork.ovn.service.health_check"
+
+	// The external_ids keys of the load balancer of a service
+	serviceKey         = "service"
+	serviceVIPKey      = "vip"
+	servicePortsKey    = "ports"
+	serviceProtocolKey = "protocol"
+	serviceBackendsKey = "backends"
+	serviceHealthKey   = "health-check-source-ip"
+
+	protocolTCP = "tcp"
+	protocolUDP = "udp"
+)
+
+var validServiceName = validTenant
+
+// healthCheckOptions are the options of a Load_Balancer_Health_Check, all
+// in seconds or counts
+var healthCheckOptions = map[string]bool{
+	"interval":      true,
+	"timeout":       true,
+	"success_count": true,
+	"failure_count": true,
+}
+
+// service is a service as the labels of a container describe it
+type service struct {
+	Name     string
+	VIP      string
+	Ports    []servicePort
+	Protocol string
+	// HealthCheck holds the options of the health checks of the ports and
+	// HealthSourceIP the address of their probes, nil without health checks
+	HealthCheck    map[string]string
+	HealthSourceIP string
+}
+
+type servicePort struct {
+	Port       int
+	TargetPort int
+}
+
+// serviceLBName is the load balancer of a service on a logical switch
+func serviceLBName(switchName, serviceName string) string {
+	return "svc-" + switchName + "-" + serviceName
+}
+
+// parseService returns the service of the labels of a container, nil when
+// it backs none
+func parseService(labels map[string]string) (*service, error) {
+	name := labels[serviceLabel]
+	if name == "" {
+		return nil, nil
+	}
+	if !validServiceName.MatchString(name) {
+		return nil, fmt.Errorf("%s is not a valid service name", name)
+	}
+	svc := &service{
+		Name:     name,
+		VIP:      labels[serviceVIPLabel],
+		Protocol: labels[serviceProtocolLabel],
+	}
+	if svc.VIP != "" {
+		if ip := net.ParseIP(svc.VIP); ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("%s is not a valid %s", svc.VIP, serviceVIPLabel)
+		}
+	}
+	ports, err := parseServicePorts(labels[servicePortsLabel])
+	if err != nil {
+		return nil, err
+	}
+	svc.Ports = ports
+	if svc.Protocol == "" && len(svc.Ports) > 0 {
+		svc.Protocol = protocolTCP
+	}
+	if svc.Protocol != "" && svc.Protocol != protocolTCP && svc.Protocol != protocolUDP {
+		return nil, fmt.Errorf("%s is not a valid %s", svc.Protocol, serviceProtocolLabel)
+	}
+	if hc := labels[serviceHealthCheckLabel]; hc != "" {
+		if len(svc.Ports) == 0 {
+			return nil, fmt.Errorf("%s needs %s", serviceHealthCheckLabel, servicePortsLabel)
+		}
+		if svc.HealthCheck, svc.HealthSourceIP, err = parseHealthCheck(hc); err != nil {
+			return nil, err
+		}
+	}
+	return svc, nil
+}
+
+// parseHealthCheck parses a list of option=value of a health check
+func parseHealthCheck(s string) (map[string]string, string, error) {
+	options := make(map[string]string)
+	var sourceIP string
+	for _, o := range strings.Split(s, ",") {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 {
+			return nil, "", fmt.Errorf("%s is not a valid option of %s", o, serviceHealthCheckLabel)
+		}
+		if kv[0] == "source_ip" {
+			if ip := net.ParseIP(kv[1]); ip == nil || ip.To4() == nil {
+				return nil, "", fmt.Errorf("%s is not a valid source_ip of %s", kv[1], serviceHealthCheckLabel)
+			}
+			sourceIP = kv[1]
+			continue
+		}
+		if !healthCheckOptions[kv[0]] {
+			return nil, "", fmt.Errorf("%s is not a valid option of %s", kv[0], serviceHealthCheckLabel)
+		}
+		if v, err := strconv.Atoi(kv[1]); err != nil || v < 1 {
+			return nil, "", fmt.Errorf("%s is not a valid %s of %s", kv[1], kv[0], serviceHealthCheckLabel)
+		}
+		options[kv[0]] = kv[1]
+	}
+	if sourceIP == "" {
+		return nil, "", fmt.Errorf("%s needs a source_ip", serviceHealthCheckLabel)
+	}
+	return options, sourceIP, nil
+}
+
+// parseServicePorts parses a list of port[:target_port]
+func parseServicePorts(s string) ([]servicePort, error) {
+	var ports []servicePort
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		parts := strings.SplitN(p, ":", 2)
+		port, err := strconv.Atoi(parts[0])
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("%s is not a valid port of %s", p, servicePortsLabel)
+		}
+		target := port
+		if len(parts) == 2 {
+			target, err = strconv.Atoi(parts[1])
+			if err != nil || target < 1 || target > 65535 {
+				return nil, fmt.Errorf("%s is not a valid port of %s", p, servicePortsLabel)
+			}
+		}
+		ports = append(ports, servicePort{Port: port, TargetPort: target})
+	}
+	return ports, nil
+}
+
+func formatServicePorts(ports []servicePort) string {
+	var s []string
+	for _, p := range ports {
+		if p.TargetPort == p.Port {
+			s = append(s, strconv.Itoa(p.Port))
+		} else {
+			s = append(s, fmt.Sprintf("%d:%d", p.Port, p.TargetPort))
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+// vips returns the vips column of the load balancer of the service with
+// the backends, e.g. 10.0.0.100:80 -> 10.0.0.2:8080,10.0.0.3:8080
+func (svc *service) vips(backends []string) map[string]string {
+	if len(svc.Ports) == 0 {
+		return map[string]string{svc.VIP: strings.Join(backends, ",")}
+	}
+	vips := make(map[string]string)
+	for _, p := range svc.Ports {
+		var targets []string
+		for _, b := range backends {
+			targets = append(targets, b+":"+strconv.Itoa(p.TargetPort))
+		}
+		vips[svc.VIP+":"+strconv.Itoa(p.Port)] = strings.Join(targets, ",")
+	}
+	return vips
+}
+
+// serviceFromLB returns the service a load balancer row was created for
+func serviceFromLB(externalIDs map[string]string) *service {
+	ports, _ := parseServicePorts(externalIDs[servicePortsKey])
+	return &service{
+		Name:     externalIDs[serviceKey],
+		VIP:      externalIDs[serviceVIPKey],
+		Ports:    ports,
+		Protocol: externalIDs[serviceProtocolKey],
+		// the health checks are rows of their own, only the source of the
+		// probes matters to the backends
+		HealthSourceIP: externalIDs[serviceHealthKey],
+	}
+}
+
+// ipPortMapping is the value of the ip_port_mappings of a backend, which
+// tells the service monitor the logical port to probe it through
+func (svc *service) ipPortMapping(logicalPortName string) string {
+	return logicalPortName + ":" + svc.HealthSourceIP
+}
+
+// ipPortMappingOp sets, or removes when mapping is empty, the
+// ip_port_mappings of the backend ip of the load balancer uuid
+func ipPortMappingOp(uuid, ip, mapping string) libovsdb.Operation {
+	deleteSet, _ := libovsdb.NewOvsSet([]string{ip})
+	mutations := []interface{}{libovsdb.NewMutation("ip_port_mappings", "delete", deleteSet)}
+	if mapping != "" {
+		insertMap, _ := libovsdb.NewOvsMap(map[string]string{ip: mapping})
+		mutations = append(mutations, libovsdb.NewMutation("ip_port_mappings", "insert", insertMap))
+	}
+	return libovsdb.Operation{
+		Op:        "mutate",
+		Table:     "Load_Balancer",
+		Mutations: mutations,
+		Where:     []interface{}{libovsdb.NewCondition("_uuid", "==", libovsdb.UUID{GoUUID: uuid})},
+	}
+}
+
+func splitBackends(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// endpointIP is the address of an endpoint without its prefix length
+func endpointIP(ep *EndpointState) string {
+	return strings.Split(ep.addr, "/")[0]
+}
+
+// joinService adds a joined endpoint to the load balancer of the service
+// the labels of its container name, if any
+func (d *Driver) joinService(r *request, ns *NetworkState, ep *EndpointState, labels map[string]string) error {
+	svc, err := parseService(labels)
+	if err != nil || svc == nil {
+		return err
+	}
+	return d.ovnnber.addServiceBackend(r, ns, svc, endpointIP(ep), ep.LogicalPortName)
+}
+
+// leaveService removes a leaving endpoint from the load balancers of the
+// network it backs
+func (d *Driver) leaveService(r *request, ns *NetworkState, ep *EndpointState) error {
+	if ep.addr == "" {
+		return nil
+	}
+	return d.ovnnber.removeServiceBackend(r, ns, endpointIP(ep))
+}
+
+// addServiceBackend adds ip, of the logical port logicalPortName, to the
+// backends of the load balancer of the service on the switch of the network,
+// which is created with the VIP and the health checks of the service and
+// attached to the switch for the first backend
+func (ovnnber *ovnnber) addServiceBackend(r *request, ns *NetworkState, svc *service, ip, logicalPortName string) error {
+	return retryConflict(r, "load balancer", func() error {
+		return ovnnber.tryAddServiceBackend(r, ns, svc, ip, logicalPortName)
+	})
+}
+
+func (ovnnber *ovnnber) tryAddServiceBackend(r *request, ns *NetworkState, svc *service, ip, logicalPortName string) error {
+	lbName := serviceLBName(ns.BridgeName, svc.Name)
+	rows, err := ovnnber.selectRows("Load_Balancer", libovsdb.NewCondition("name", "==", lbName))
+	if err != nil {
+		return err
+	}
+
+	if len(rows) == 0 {
+		if svc.VIP == "" {
+			return fmt.Errorf("service [ %s ] has no %s", svc.Name, serviceVIPLabel)
+		}
+		r.log.Infof("Create load balancer [ %s ] of service [ %s ] with VIP [ %s ]", lbName, svc.Name, svc.VIP)
+		backends := []string{ip}
+		return ovnnber.createServiceLB(r, ns, lbName, svc, backends, map[string]string{ip: svc.ipPortMapping(logicalPortName)})
+	}
+
+	row := rows[0]
+	externalIDs := getRowMap(row, "external_ids")
+	current := serviceFromLB(externalIDs)
+	if (svc.VIP != "" && svc.VIP != current.VIP) || (len(svc.Ports) > 0 && formatServicePorts(svc.Ports) != externalIDs[servicePortsKey]) ||
+		(svc.HealthSourceIP != "" && svc.HealthSourceIP != current.HealthSourceIP) {
+		r.log.Warnf("service [ %s ] has VIP [ %s ] ports [ %s ] health check source [ %s ], the labels of the container are ignored",
+			svc.Name, current.VIP, externalIDs[servicePortsKey], current.HealthSourceIP)
+	}
+	backends := splitBackends(externalIDs[serviceBackendsKey])
+	for _, b := range backends {
+		if b == ip {
+			return nil
+		}
+	}
+	backends = append(backends, ip)
+	sort.Strings(backends)
+	r.log.Infof("Add backend [ %s ] to load balancer [ %s ]", ip, lbName)
+	uuid := getRowUUID(row)
+	var ops []libovsdb.Operation
+	if current.HealthSourceIP != "" {
+		ops = append(ops, ipPortMappingOp(uuid, ip, current.ipPortMapping(logicalPortName)))
+	}
+	return ovnnber.updateServiceLB(r, uuid, current, externalIDs, backends, ops...)
+}
+
+// removeServiceBackend removes ip from the backends of the load balancers of
+// the services on the switch of the network, deleting the ones left without
+func (ovnnber *ovnnber) removeServiceBackend(r *request, ns *NetworkState, ip string) error {
+	return retryConflict(r, "load balancer", func() error {
+		return ovnnber.tryRemoveServiceBackend(r, ns, ip)
+	})
+}
+
+func (ovnnber *ovnnber) tryRemoveServiceBackend(r *request, ns *NetworkState, ip string) error {
+	rows, err := ovnnber.switchLoadBalancers(ns.BridgeName)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		externalIDs := getRowMap(row, "external_ids")
+		var backends []string
+		found := false
+		for _, b := range splitBackends(externalIDs[serviceBackendsKey]) {
+			if b == ip {
+				found = true
+				continue
+			}
+			backends = append(backends, b)
+		}
+		if !found {
+			continue
+		}
+		lbName, _ := row["name"].(string)
+		uuid := getRowUUID(row)
+		if len(backends) == 0 {
+			r.log.Infof("Delete load balancer [ %s ] of service [ %s ] without backends", lbName, externalIDs[serviceKey])
+			if err := ovnnber.deleteServiceLB(r, ns.BridgeName, uuid, externalIDs); err != nil {
+				return err
+			}
+			continue
+		}
+		r.log.Infof("Remove backend [ %s ] from load balancer [ %s ]", ip, lbName)
+		if err := ovnnber.updateServiceLB(r, uuid, serviceFromLB(externalIDs), externalIDs, backends, ipPortMappingOp(uuid, ip, "")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// switchLoadBalancers returns the load balancers of the services on a switch.
+// In local scope the hosts share the switch under different network IDs and
+// the net-id of a load balancer is the one of the host that created it, so
+// they are found through the load_balancer column of the switch.
+func (ovnnber *ovnnber) switchLoadBalancers(switchName string) ([]map[string]interface{}, error) {
+	switches, err := ovnnber.selectRows("Logical_Switch", libovsdb.NewCondition("name", "==", switchName))
+	if err != nil {
+		return nil, err
+	}
+	attached := make(map[string]bool)
+	for _, sw := range switches {
+		for _, uuid := range getRowRefs(sw, "load_balancer") {
+			attached[uuid] = true
+		}
+	}
+	if len(attached) == 0 {
+		return nil, nil
+	}
+	rows, err := selectTable(ovnnber.client(), "OVN_Northbound", "Load_Balancer")
+	if err != nil {
+		return nil, err
+	}
+	var lbs []map[string]interface{}
+	for _, row := range rows {
+		if attached[getRowUUID(row)] && getRowMap(row, "external_ids")[serviceKey] != "" {
+			lbs = append(lbs, row)
+		}
+	}
+	return lbs, nil
+}
+
+// createServiceLB inserts the load balancer of a service, with a health check
+// per VIP when the service has them, and attaches it to the switch of the
+// network, as ovn-nbctl lb-add and ls-lb-add do
+func (ovnnber *ovnnber) createServiceLB(r *request, ns *NetworkState, lbName string, svc *service, backends []string, ipPortMappings map[string]string) error {
+	namedLBUUID := "lb"
+
+	externalIDs := tenantExternalIDs(ns.Tenant)
+	externalIDs[netIDKey] = ns.id
+	externalIDs[serviceKey] = svc.Name
+	externalIDs[serviceVIPKey] = svc.VIP
+	externalIDs[serviceBackendsKey] = strings.Join(backends, ",")
+	if len(svc.Ports) > 0 {
+		externalIDs[servicePortsKey] = formatServicePorts(svc.Ports)
+		externalIDs[serviceProtocolKey] = svc.Protocol
+	}
+	externalIDsMap, _ := libovsdb.NewOvsMap(externalIDs)
+	vips, _ := libovsdb.NewOvsMap(svc.vips(backends))
+
+	lb := make(map[string]interface{})
+	lb["name"] = lbName
+	lb["vips"] = vips
+	lb["external_ids"] = externalIDsMap
+	if svc.Protocol != "" {
+		lb["protocol"] = svc.Protocol
+	}
+
+	var operations []libovsdb.Operation
+	if svc.HealthCheck != nil {
+		externalIDs[serviceHealthKey] = svc.HealthSourceIP
+		externalIDsMap, _ = libovsdb.NewOvsMap(externalIDs)
+		lb["external_ids"] = externalIDsMap
+		mappings, _ := libovsdb.NewOvsMap(ipPortMappings)
+		lb["ip_port_mappings"] = mappings
+
+		options, _ := libovsdb.NewOvsMap(svc.HealthCheck)
+		hcExternalIDs, _ := libovsdb.NewOvsMap(map[string]string{serviceKey: svc.Name})
+		var healthChecks []libovsdb.UUID
+		for i, p := range svc.Ports {
+			namedHCUUID := fmt.Sprintf("hc%d", i)
+			hc := make(map[string]interface{})
+			hc["vip"] = svc.VIP + ":" + strconv.Itoa(p.Port)
+			hc["options"] = options
+			hc["external_ids"] = hcExternalIDs
+			operations = append(operations, libovsdb.Operation{
+				Op:       "insert",
+				Table:    "Load_Balancer_Health_Check",
+				Row:      hc,
+				UUIDName: namedHCUUID,
+			})
+			healthChecks = append(healthChecks, libovsdb.UUID{GoUUID: namedHCUUID})
+		}
+		healthCheckSet, _ := libovsdb.NewOvsSet(healthChecks)
+		lb["health_check"] = healthCheckSet
+		r.log.Infof("Check the health of the backends of [ %s ] from [ %s ] with %v", lbName, svc.HealthSourceIP, svc.HealthCheck)
+	}
+
+	insertOp := libovsdb.Operation{
+		Op:       "insert",
+		Table:    "Load_Balancer",
+		Row:      lb,
+		UUIDName: namedLBUUID,
+	}
+
+	lbSet, _ := libovsdb.NewOvsSet([]libovsdb.UUID{{GoUUID: namedLBUUID}})
+	mutateOp := libovsdb.Operation{
+		Op:        "mutate",
+		Table:     "Logical_Switch",
+		Mutations: []interface{}{libovsdb.NewMutation("load_balancer", "insert", lbSet)},
+		Where:     []interface{}{libovsdb.NewCondition("name", "==", ns.BridgeName)},
+	}
+	// the name of a load balancer is not unique: the wait fails when another
+	// host created the one of the service since it was looked up. libovsdb
+	// omits empty rows, so it waits until the rows named lbName are not the
+	// one row named lbName rather than until they are none.
+	waitOp := libovsdb.Operation{
+		Op:      "wait",
+		Table:   "Load_Balancer",
+		Where:   []interface{}{libovsdb.NewCondition("name", "==", lbName)},
+		Columns: []string{"name"},
+		Until:   "!=",
+		Rows:    []map[string]interface{}{{"name": lbName}},
+		Timeout: waitTimeout,
+	}
+	operations = append([]libovsdb.Operation{waitOp}, operations...)
+	operations = append(operations, insertOp, mutateOp)
+	return ovnnber.transactWait(r, operations...)
+}
+
+// updateServiceLB sets the backends of the load balancer of a service, in
+// one transaction with ops
+func (ovnnber *ovnnber) updateServiceLB(r *request, uuid string, svc *service, externalIDs map[string]string, backends []string, ops ...libovsdb.Operation) error {
+	waitOp := waitExternalIDsOp(uuid, externalIDs)
+	externalIDs[serviceBackendsKey] = strings.Join(backends, ",")
+	externalIDsMap, _ := libovsdb.NewOvsMap(externalIDs)
+	vips, _ := libovsdb.NewOvsMap(svc.vips(backends))
+
+	lb := make(map[string]interface{})
+	lb["vips"] = vips
+	lb["external_ids"] = externalIDsMap
+	updateOp := libovsdb.Operation{
+		Op:    "update",
+		Table: "Load_Balancer",
+		Row:   lb,
+		Where: []interface{}{libovsdb.NewCondition("_uuid", "==", libovsdb.UUID{GoUUID: uuid})},
+	}
+	return ovnnber.transactWait(r, append([]libovsdb.Operation{waitOp, updateOp}, ops...)...)
+}
+
+// deleteServiceLB detaches the load balancer uuid from the switch and
+// deletes it, with its health checks, unless its external_ids changed
+func (ovnnber *ovnnber) deleteServiceLB(r *request, switchName, uuid string, externalIDs map[string]string) error {
+	lbSet, _ := libovsdb.NewOvsSet([]libovsdb.UUID{{GoUUID: uuid}})
+	mutateOp := libovsdb.Operation{
+		Op:        "mutate",
+		Table:     "Logical_Switch",
+		Mutations: []interface{}{libovsdb.NewMutation("load_balancer", "delete", lbSet)},
+		Where:     []interface{}{libovsdb.NewCondition("name", "==", switchName)},
+	}
+	deleteOp := libovsdb.Operation{
+		Op:    "delete",
+		Table: "Load_Balancer",
+		Where: []interface{}{libovsdb.NewCondition("_uuid", "==", libovsdb.UUID{GoUUID: uuid})},
+	}
+	return ovnnber.transactWait(r, waitExternalIDsOp(uuid, externalIDs), mutateOp, deleteOp)
+}
+
+// waitExternalIDsOp is a wait operation failing when the external_ids of the
+// load balancer uuid, which record its backends, are no longer externalIDs
+func waitExternalIDsOp(uuid string, externalIDs map[string]string) libovsdb.Operation {
+	externalIDsMap, _ := libovsdb.NewOvsMap(externalIDs)
+	return libovsdb.Operation{
+		Op:      "wait",
+		Table:   "Load_Balancer",
+		Where:   []interface{}{libovsdb.NewCondition("_uuid", "==", libovsdb.UUID{GoUUID: uuid})},
+		Columns: []string{"external_ids"},
+		Until:   "==",
+		Rows:    []map[string]interface{}{{"external_ids": externalIDsMap}},
+		Timeout: waitTimeout,
+	}
+}
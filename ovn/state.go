@@ -0,0 +1,194 @@
+package ovn
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/samalba/dockerclient"
+	"github.com/socketplane/libovsdb"
+)
+
+// The external_ids keys of the logical switch of a network holding its
+// NetworkState, so that every host learns the whole network from the OVN
+// Northbound, whichever created it
+const (
+	netIDKey           = "net-id"
+	mtuKey             = "mtu"
+	modeKey            = "mode"
+	gatewayKey         = "gateway"
+	gatewayMaskKey     = "gateway-mask"
+	bindInterfaceKey   = "bind-interface"
+	addressesKey       = "addresses"
+	joinWaitKey        = "join-wait"
+	joinWaitTimeoutKey = "join-wait-timeout"
+	physicalNetworkKey = "physical-network"
+	vlanKey            = "vlan"
+	netNameKey         = "net-name"
+)
+
+var networkStateKeys = []string{
+	netIDKey, mtuKey, modeKey, gatewayKey, gatewayMaskKey, bindInterfaceKey, addressesKey,
+	joinWaitKey, joinWaitTimeoutKey, physicalNetworkKey, vlanKey, tenantKey, netNameKey,
+}
+
+// externalIDs returns the external_ids recording the network state, without
+// the empty values
+func (ns *NetworkState) externalIDs() map[string]string {
+	m := map[string]string{
+		netIDKey:           ns.id,
+		mtuKey:             strconv.Itoa(ns.MTU),
+		modeKey:            ns.Mode,
+		gatewayKey:         ns.Gateway,
+		gatewayMaskKey:     ns.GatewayMask,
+		bindInterfaceKey:   ns.FlatBindInterface,
+		addressesKey:       addressesStatic,
+		joinWaitKey:        ns.JoinWait,
+		joinWaitTimeoutKey: ns.JoinWaitTimeout.String(),
+		physicalNetworkKey: ns.PhysicalNetwork,
+		tenantKey:          ns.Tenant,
+		netNameKey:         ns.Name,
+	}
+	if ns.DynamicAddresses {
+		m[addressesKey] = addressesDynamic
+	}
+	if ns.VLAN != 0 {
+		m[vlanKey] = strconv.Itoa(ns.VLAN)
+	}
+	for k, v := range m {
+		if v == "" {
+			delete(m, k)
+		}
+	}
+	return m
+}
+
+// networkStateFromExternalIDs rebuilds the state of the network of the
+// logical switch bridgeName from its external_ids, with the defaults of the
+// config for what they do not record, e.g. on a switch created by an older
+// plugin. It returns nil when the switch belongs to no network.
+func networkStateFromExternalIDs(bridgeName string, externalIDs map[string]string) *NetworkState {
+	if externalIDs[netIDKey] == "" {
+		return nil
+	}
+	ns := &NetworkState{
+		id:                externalIDs[netIDKey],
+		BridgeName:        bridgeName,
+		MTU:               config.DefaultMTU,
+		Mode:              config.DefaultMode,
+		Gateway:           externalIDs[gatewayKey],
+		GatewayMask:       externalIDs[gatewayMaskKey],
+		FlatBindInterface: externalIDs[bindInterfaceKey],
+		DynamicAddresses:  externalIDs[addressesKey] == addressesDynamic,
+		Tenant:            externalIDs[tenantKey],
+		PhysicalNetwork:   externalIDs[physicalNetworkKey],
+		Name:              externalIDs[netNameKey],
+	}
+	if mtu, err := strconv.Atoi(externalIDs[mtuKey]); err == nil {
+		ns.MTU = mtu
+	}
+	if validModes[externalIDs[modeKey]] {
+		ns.Mode = externalIDs[modeKey]
+	}
+	if vlan, err := strconv.Atoi(externalIDs[vlanKey]); err == nil {
+		ns.VLAN = vlan
+	}
+	if ns.PhysicalNetwork == "" {
+		ns.PhysicalNetwork = config.PhysicalNetwork
+	}
+	ns.JoinWait, ns.JoinWaitTimeout = config.JoinWait, config.JoinWaitTimeout.Duration
+	if validJoinWaits[externalIDs[joinWaitKey]] {
+		ns.JoinWait = externalIDs[joinWaitKey]
+	}
+	if d, err := time.ParseDuration(externalIDs[joinWaitTimeoutKey]); err == nil && d > 0 {
+		ns.JoinWaitTimeout = d
+	}
+	return ns
+}
+
+// networkStateFromResource rebuilds the state of a network from its options
+// in Docker
+func networkStateFromResource(nw *dockerclient.NetworkResource, bridgeName string) *NetworkState {
+	joinWait, joinWaitTimeout, err := parseJoinWait(nw.Options[joinWaitOption], nw.Options[joinWaitTimeoutOption])
+	if err != nil {
+		log.Errorf("network [ %s ]: %s", nw.Name, err)
+		joinWait, joinWaitTimeout = config.JoinWait, config.JoinWaitTimeout.Duration
+	}
+	ns := &NetworkState{
+		id:                nw.ID,
+		BridgeName:        bridgeName,
+		MTU:               config.DefaultMTU,
+		Mode:              config.DefaultMode,
+		FlatBindInterface: nw.Options[bindInterfaceOption],
+		DynamicAddresses:  nw.Options[addressesOption] == addressesDynamic,
+		JoinWait:          joinWait,
+		JoinWaitTimeout:   joinWaitTimeout,
+		Tenant:            nw.Options[tenantOption],
+		PhysicalNetwork:   nw.Options[physicalNetworkOption],
+		Name:              nw.Name,
+		subnet:            nw.Options[subnetOption],
+	}
+	if validModes[nw.Options[modeOption]] {
+		ns.Mode = nw.Options[modeOption]
+	}
+	if vlan, err := strconv.Atoi(nw.Options[vlanOption]); err == nil {
+		ns.VLAN = vlan
+	}
+	if ns.PhysicalNetwork == "" {
+		ns.PhysicalNetwork = config.PhysicalNetwork
+	}
+	if len(nw.IPAM.Config) > 0 {
+		ns.Gateway = nw.IPAM.Config[0].Gateway
+		if _, subnet, err := net.ParseCIDR(nw.IPAM.Config[0].Subnet); err == nil {
+			ones, _ := subnet.Mask.Size()
+			ns.GatewayMask = strconv.Itoa(ones)
+		}
+	}
+	return ns
+}
+
+// saveNetworkState records the state of a network in the external_ids of
+// its logical switch, replacing what an earlier state recorded
+func (ovnnber *ovnnber) saveNetworkState(r *request, ns *NetworkState) error {
+	deleteSet, _ := libovsdb.NewOvsSet(networkStateKeys)
+	insertMap, _ := libovsdb.NewOvsMap(ns.externalIDs())
+	mutateOp := libovsdb.Operation{
+		Op:    "mutate",
+		Table: "Logical_Switch",
+		Mutations: []interface{}{
+			libovsdb.NewMutation("external_ids", "delete", deleteSet),
+			libovsdb.NewMutation("external_ids", "insert", insertMap),
+		},
+		Where: []interface{}{libovsdb.NewCondition("name", "==", ns.BridgeName)},
+	}
+	return ovnnber.transactOps(r, mutateOp)
+}
+
+// loadNetworkState reads the state of network netid from the external_ids
+// of the logical switch bridgeName, nil when the switch does not record it
+func (ovnnber *ovnnber) loadNetworkState(netid, bridgeName string) (*NetworkState, error) {
+	rows, err := ovnnber.selectRows("Logical_Switch", libovsdb.NewCondition("name", "==", bridgeName))
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	externalIDs := getRowMap(rows[0], "external_ids")
+	// a switch without the mtu predates the recorded state
+	if externalIDs[netIDKey] != netid || externalIDs[mtuKey] == "" {
+		return nil, nil
+	}
+	return networkStateFromExternalIDs(bridgeName, externalIDs), nil
+}
+
+// ovsMapStrings converts an OvsMap of a table update into a string map
+func ovsMapStrings(m libovsdb.OvsMap) map[string]string {
+	s := make(map[string]string)
+	for k, v := range m.GoMap {
+		key, ok := k.(string)
+		value, ok2 := v.(string)
+		if ok && ok2 {
+			s[key] = value
+		}
+	}
+	return s
+}
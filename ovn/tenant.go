@@ -0,0 +1,173 @@
+package ovn
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/socketplane/libovsdb"
+)
+
+const (
+	// tenantOption names the tenant a network belongs to. The networks of a
+	// tenant are routed through the tenant's own logical router and are
+	// never connected to the networks of other tenants.
+	tenantOption = "net.libnetwork.ovn.tenant"
+
+	// tenantKey is the external_ids key the northbound rows of a tenant are
+	// tagged with
+	tenantKey = "tenant"
+)
+
+var validTenant = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+func getTenant(r *network.CreateNetworkRequest) (string, error) {
+	if r.Options != nil {
+		if tenant, ok := r.Options[tenantOption].(string); ok && tenant != "" {
+			if !validTenant.MatchString(tenant) {
+				return "", fmt.Errorf("%s is not a valid tenant name", tenant)
+			}
+			return tenant, nil
+		}
+	}
+	return "", nil
+}
+
+// tenantRouterName is the logical router of a tenant
+func tenantRouterName(tenant string) string {
+	return "tenant-" + tenant
+}
+
+// networkRouter is the logical router a network is attached to: the one of
+// its tenant, or the default router, if any
+func networkRouter(tenant string) string {
+	if tenant != "" {
+		return tenantRouterName(tenant)
+	}
+	return config.DefaultRouter
+}
+
+func tenantString(tenant string) string {
+	if tenant == "" {
+		return "no tenant"
+	}
+	return "tenant [ " + tenant + " ]"
+}
+
+// checkTenant fails when the row of table named name exists and belongs to
+// another tenant than tenant, so that it is not shared across tenants
+func (ovnnber *ovnnber) checkTenant(table, name, tenant string) error {
+	rows, err := ovnnber.selectRows(table, libovsdb.NewCondition("name", "==", name))
+	if err != nil || len(rows) == 0 {
+		return err
+	}
+	if owner := getRowMap(rows[0], "external_ids")[tenantKey]; owner != tenant {
+		return fmt.Errorf("%s [ %s ] belongs to %s, not to %s", table, name, tenantString(owner), tenantString(tenant))
+	}
+	return nil
+}
+
+// checkRouterSubnets fails when subnet overlaps a network already attached
+// to the router, as the networks of a tenant share its router
+func (ovnnber *ovnnber) checkRouterSubnets(routerName string, subnet *net.IPNet) error {
+	rows, err := ovnnber.selectRows("Logical_Router", libovsdb.NewCondition("name", "==", routerName))
+	if err != nil || len(rows) == 0 {
+		return err
+	}
+	ports := make(map[string]bool)
+	for _, uuid := range getRowRefs(rows[0], "ports") {
+		ports[uuid] = true
+	}
+
+	routerPorts, err := selectTable(ovnnber.client(), "OVN_Northbound", "Logical_Router_Port")
+	if err != nil {
+		return err
+	}
+	for _, port := range routerPorts {
+		if !ports[getRowUUID(port)] {
+			continue
+		}
+		for _, network := range getRowSet(port, "networks") {
+			_, attached, err := net.ParseCIDR(network)
+			if err != nil {
+				continue
+			}
+			if attached.Contains(subnet.IP) || subnet.Contains(attached.IP) {
+				name, _ := port["name"].(string)
+				return fmt.Errorf("subnet [ %s ] overlaps [ %s ] of router port [ %s ] on router [ %s ]", subnet, attached, name, routerName)
+			}
+		}
+	}
+	return nil
+}
+
+// tenantExternalIDs are the external_ids of a new row of the tenant
+func tenantExternalIDs(tenant string) map[string]string {
+	if tenant == "" {
+		return map[string]string{}
+	}
+	return map[string]string{tenantKey: tenant}
+}
+
+// setExternalID sets one external_ids key of the row of table named name
+func (ovnnber *ovnnber) setExternalID(r *request, table, name, key, value string) error {
+	deleteSet, _ := libovsdb.NewOvsSet([]string{key})
+	insertMap, _ := libovsdb.NewOvsMap(map[string]string{key: value})
+	mutateOp := libovsdb.Operation{
+		Op:    "mutate",
+		Table: table,
+		Mutations: []interface{}{
+			libovsdb.NewMutation("external_ids", "delete", deleteSet),
+			libovsdb.NewMutation("external_ids", "insert", insertMap),
+		},
+		Where: []interface{}{libovsdb.NewCondition("name", "==", name)},
+	}
+	return ovnnber.transactOps(r, mutateOp)
+}
+
+// tagTenant tags the row of table named name with the tenant, if any
+func (ovnnber *ovnnber) tagTenant(r *request, table, name, tenant string) error {
+	if tenant == "" {
+		return nil
+	}
+	return ovnnber.setExternalID(r, table, name, tenantKey, tenant)
+}
+
+// claimSandbox records that the endpoint joins the sandbox, unless the
+// sandbox already has an endpoint on a network of another tenant, which would
+// connect the two through the container. The check and the record are made
+// under epmu, so that concurrent Joins of one container see each other.
+func (d *Driver) claimSandbox(ep *EndpointState, sandboxKey, tenant string) error {
+	d.epmu.Lock()
+	defer d.epmu.Unlock()
+	for _, other := range d.endpoints {
+		if other == ep || other.sandboxKey != sandboxKey || other.networkID == "" {
+			continue
+		}
+		ns, ok := d.network(other.networkID)
+		if !ok {
+			continue
+		}
+		if ns.Tenant != tenant {
+			return fmt.Errorf("the container is on network [ %s ] of %s and can not join a network of %s", other.networkID, tenantString(ns.Tenant), tenantString(tenant))
+		}
+	}
+	ep.sandboxKey = sandboxKey
+	return nil
+}
+
+// sandbox returns the sandbox the endpoint joined, empty when it did not
+func (d *Driver) sandbox(ep *EndpointState) string {
+	d.epmu.RLock()
+	defer d.epmu.RUnlock()
+	return ep.sandboxKey
+}
+
+// releaseSandbox forgets the sandbox of an endpoint that left or failed to
+// join it
+func (d *Driver) releaseSandbox(ep *EndpointState) {
+	d.epmu.Lock()
+	defer d.epmu.Unlock()
+	ep.sandboxKey = ""
+}
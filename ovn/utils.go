@@ -40,16 +40,15 @@ func getIfaceAddr(name string) (*net.IPNet, error) {
 
 // Set the IP addr of a netlink interface
 func setInterfaceIP(name string, rawIP string) error {
-	retries := 2
 	var iface netlink.Link
 	var err error
-	for i := 0; i < retries; i++ {
+	for i := 0; i < config.LinkRetries; i++ {
 		iface, err = netlink.LinkByName(name)
 		if err == nil {
 			break
 		}
 		log.Debugf("error retrieving new OVS bridge netlink link [ %s ]... retrying", name)
-		time.Sleep(2 * time.Second)
+		time.Sleep(config.LinkRetryInterval.Duration)
 	}
 	if err != nil {
 		log.Fatalf("Abandoning retrieving the new OVS bridge link from netlink, Run [ ip link ] to troubleshoot the error: %s", err)
@@ -97,8 +96,8 @@ func validateIface(ifaceStr string) bool {
 	return true
 }
 
-func createVethPair(vethOut, vethIn, mac string) error {
-	log.Infof("Create veth [%s %s]", vethOut, vethIn)
+func createVethPair(r *request, vethOut, vethIn, mac string) error {
+	r.log.Infof("Create veth [%s %s]", vethOut, vethIn)
 
 	nlh := ns.NlHandle()
 
@@ -106,9 +105,11 @@ func createVethPair(vethOut, vethIn, mac string) error {
 	veth := &netlink.Veth{
 		LinkAttrs: netlink.LinkAttrs{Name: vethOut, TxQLen: 0},
 		PeerName:  vethIn}
-	fmt.Println("type:", veth.Type())
+	r.log.Debugf("Link type: %s", veth.Type())
 
-	if err := nlh.LinkAdd(veth); err != nil {
+	err := nlh.LinkAdd(veth)
+	r.auditLink("add veth peer "+vethIn, vethOut, err)
+	if err != nil {
 		return fmt.Errorf("error creating veth pair: %v", err)
 	}
 
@@ -123,7 +124,9 @@ func createVethPair(vethOut, vethIn, mac string) error {
 		return fmt.Errorf("failed to parse mac %s : %s", mac, err.Error())
 	}
 
-	if err := nlh.LinkSetHardwareAddr(l, hwAddr); err != nil {
+	err = nlh.LinkSetHardwareAddr(l, hwAddr)
+	r.auditLink("set address "+mac, vethIn, err)
+	if err != nil {
 		return fmt.Errorf("failed to set bridge mac-address %s : %s", hwAddr, err.Error())
 	}
 
@@ -132,7 +135,9 @@ func createVethPair(vethOut, vethIn, mac string) error {
 	if err != nil {
 		return fmt.Errorf("failed to get link by name %s : %s", vethIn, err.Error())
 	}
-	if err := nlh.LinkSetUp(l); err != nil {
+	err = nlh.LinkSetUp(l)
+	r.auditLink("set up", vethOut, err)
+	if err != nil {
 		return fmt.Errorf("failed to set link up %s", err.Error())
 	}
 	return nil
@@ -0,0 +1,208 @@
+package ovn
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/socketplane/libovsdb"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// joinWaitOption selects what Join waits for before returning: none,
+	// up (the logical port is up) or binding (this chassis has bound it)
+	joinWaitOption = "net.libnetwork.ovn.join.wait"
+	// joinWaitTimeoutOption bounds the wait, e.g. 10s
+	joinWaitTimeoutOption = "net.libnetwork.ovn.join.wait_timeout"
+
+	joinWaitNone    = "none"
+	joinWaitUp      = "up"
+	joinWaitBinding = "binding"
+
+	// joinWaitPoll is the pause between two checks of the port
+	joinWaitPoll = 100 * time.Millisecond
+)
+
+var validJoinWaits = map[string]bool{
+	joinWaitNone:    true,
+	joinWaitUp:      true,
+	joinWaitBinding: true,
+}
+
+// sbber reads the OVN Southbound, connected on first use
+type sbber struct {
+	mu    sync.Mutex // guards ovsdb
+	ovsdb *libovsdb.OvsdbClient
+}
+
+// parseJoinWait returns what Join waits for on a network and for how long,
+// from the values of the network options, empty when not given
+func parseJoinWait(wait, timeout string) (string, time.Duration, error) {
+	if wait == "" {
+		wait = config.JoinWait
+	}
+	if !validJoinWaits[wait] {
+		return "", 0, fmt.Errorf("%s is not a valid %s", wait, joinWaitOption)
+	}
+	d := config.JoinWaitTimeout.Duration
+	if timeout != "" {
+		var err error
+		if d, err = time.ParseDuration(timeout); err != nil || d <= 0 {
+			return "", 0, fmt.Errorf("%s is not a valid %s", timeout, joinWaitTimeoutOption)
+		}
+	}
+	return wait, d, nil
+}
+
+func getJoinWait(r *network.CreateNetworkRequest) (string, time.Duration, error) {
+	var wait, timeout string
+	if r.Options != nil {
+		wait, _ = r.Options[joinWaitOption].(string)
+		timeout, _ = r.Options[joinWaitTimeoutOption].(string)
+	}
+	return parseJoinWait(wait, timeout)
+}
+
+// waitJoined waits, as the network says, for the logical port of an endpoint
+// that has just been plugged to be up or bound to this chassis
+func (d *Driver) waitJoined(r *request, ns *NetworkState, logicalPortName string) error {
+	var ready func() (bool, error)
+	switch ns.JoinWait {
+	case joinWaitUp:
+		ready = func() (bool, error) { return logicalPortUp(logicalPortName), nil }
+	case joinWaitBinding:
+		// the child ports of nested mode are bound to the chassis of the
+		// VM's port, which is not this host
+		if nested() {
+			ready = func() (bool, error) { return logicalPortUp(logicalPortName), nil }
+			break
+		}
+		externalIDs, err := d.ovsdber.getExternalIDs()
+		if err != nil {
+			return err
+		}
+		systemID := externalIDs["system-id"]
+		ready = func() (bool, error) { return d.portBoundTo(logicalPortName, systemID) }
+	default:
+		return nil
+	}
+
+	r.log.Debugf("Waiting up to %v for logical port [ %s ] to be %s", ns.JoinWaitTimeout, logicalPortName, ns.JoinWait)
+	deadline := time.Now().Add(ns.JoinWaitTimeout)
+	for {
+		ok, err := ready()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if ns.JoinWait == joinWaitUp {
+				return fmt.Errorf("logical port [ %s ] is not up after %v: check that ovn-controller runs on this host and is connected to the southbound", logicalPortName, ns.JoinWaitTimeout)
+			}
+			return fmt.Errorf("logical port [ %s ] is not bound to this chassis after %v: check that ovn-controller runs on this host and is connected to the southbound", logicalPortName, ns.JoinWaitTimeout)
+		}
+		time.Sleep(joinWaitPoll)
+	}
+}
+
+// logicalPortUp reads the up column of a logical port in the ovnnb cache
+func logicalPortUp(logicalPortName string) bool {
+	cacheMu.RLock()
+	defer cacheMu.RUnlock()
+	for _, row := range ovnnbCache["Logical_Switch_Port"] {
+		if name, _ := row.Fields["name"].(string); name == logicalPortName {
+			up, _ := row.Fields["up"].(bool)
+			return up
+		}
+	}
+	return false
+}
+
+// portBoundTo tells whether the chassis of the Port_Binding of a logical
+// port is systemID
+func (d *Driver) portBoundTo(logicalPortName, systemID string) (bool, error) {
+	client, err := d.southbound()
+	if err != nil {
+		return false, err
+	}
+	rows, err := selectTable(client, "OVN_Southbound", "Port_Binding", libovsdb.NewCondition("logical_port", "==", logicalPortName))
+	if err != nil {
+		d.sbber.reset(client)
+		return false, err
+	}
+	if len(rows) == 0 {
+		return false, nil
+	}
+	chassisUUID := getRowRef(rows[0], "chassis")
+	if chassisUUID == "" {
+		return false, nil
+	}
+	rows, err = selectTable(client, "OVN_Southbound", "Chassis", libovsdb.NewCondition("_uuid", "==", libovsdb.UUID{GoUUID: chassisUUID}))
+	if err != nil {
+		d.sbber.reset(client)
+		return false, err
+	}
+	if len(rows) == 0 {
+		return false, nil
+	}
+	name, _ := rows[0]["name"].(string)
+	return name == systemID, nil
+}
+
+// southbound returns the southbound connection, connecting to
+// external_ids:ovn-remote of the local Open_vSwitch if needed
+func (d *Driver) southbound() (*libovsdb.OvsdbClient, error) {
+	d.sbber.mu.Lock()
+	defer d.sbber.mu.Unlock()
+	if d.sbber.ovsdb != nil {
+		return d.sbber.ovsdb, nil
+	}
+
+	externalIDs, err := d.ovsdber.getExternalIDs()
+	if err != nil {
+		return nil, err
+	}
+	sbRemote := externalIDs["ovn-remote"]
+	if sbRemote == "" {
+		return nil, fmt.Errorf("external_ids:ovn-remote of the local Open_vSwitch is not set")
+	}
+	client, err := connectAny(sbRemote, ovnSBPort, d.ovnnber.ssl)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to OVN Southbound: %s", err)
+	}
+	d.sbber.ovsdb = client
+	return client, nil
+}
+
+// reset drops a failed southbound connection so that the next use
+// reconnects
+func (sbber *sbber) reset(client *libovsdb.OvsdbClient) {
+	sbber.mu.Lock()
+	defer sbber.mu.Unlock()
+	if sbber.ovsdb == client {
+		client.Disconnect()
+		sbber.ovsdb = nil
+	}
+}
+
+// unplugVeth removes the veth pair and the OVS port of an endpoint whose
+// Join failed, keeping the endpoint itself
+func (d *Driver) unplugVeth(r *request, ep *EndpointState) {
+	if link, err := netlink.LinkByName(ep.vethOut); err == nil {
+		err = netlink.LinkDel(link)
+		r.auditLink("delete", ep.vethOut, err)
+		if err != nil {
+			r.log.Errorf("unable to delete veth [ %s ]: %s", ep.vethOut, err)
+		}
+	}
+	if nested() {
+		return
+	}
+	if err := d.ovsdber.deletePort(r, d.ovsdber.bridge, ep.vethOut); err != nil {
+		r.log.Errorf("unable to delete OVS port [ %s ]: %s", ep.vethOut, err)
+	}
+}
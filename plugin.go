@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/huikang/libnetwork-ovn-plugin/ovn"
+	"gopkg.in/urfave/cli.v1"
+)
+
+const pluginBinary = "/usr/bin/libnetwork-ovn-plugin"
+
+// managedPluginConfig is the config.json of a Docker managed (v2) plugin
+type managedPluginConfig struct {
+	Description   string          `json:"description"`
+	Documentation string          `json:"documentation"`
+	Entrypoint    []string        `json:"entrypoint"`
+	Interface     pluginInterface `json:"interface"`
+	Network       pluginNetwork   `json:"network"`
+	Linux         pluginLinux     `json:"linux"`
+	Mounts        []pluginMount   `json:"mounts"`
+	Env           []pluginEnv     `json:"env"`
+}
+
+type pluginInterface struct {
+	Types  []string `json:"types"`
+	Socket string   `json:"socket"`
+}
+
+type pluginNetwork struct {
+	Type string `json:"type"`
+}
+
+type pluginLinux struct {
+	Capabilities []string `json:"capabilities"`
+}
+
+type pluginMount struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Options     []string `json:"options"`
+	Settable    []string `json:"settable"`
+}
+
+type pluginEnv struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Value       string   `json:"value"`
+	Settable    []string `json:"settable"`
+}
+
+var pluginConfigCommand = cli.Command{
+	Name:  "plugin-config",
+	Usage: "print the config.json to package the plugin as a Docker managed plugin",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "name",
+			Value: "huikang/ovn:latest",
+			Usage: "reference the plugin is installed as, which Docker uses as the driver name of its networks",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		config := newManagedPluginConfig(c.App.Flags, c.String("name"))
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(config); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		return nil
+	},
+}
+
+// newManagedPluginConfig declares the plugin as a network and IPAM driver
+// served on the ovn socket, running in the host network namespace with the
+// local OVSDB and the Docker sockets mounted. Every global flag and config
+// setting can be set through its environment variable with docker plugin
+// set.
+func newManagedPluginConfig(flags []cli.Flag, name string) *managedPluginConfig {
+	config := &managedPluginConfig{
+		Description:   "OVN network driver for Docker",
+		Documentation: "https://github.com/huikang/libnetwork-ovn-plugin",
+		Entrypoint:    []string{pluginBinary},
+		Interface: pluginInterface{
+			Types:  []string{"docker.networkdriver/1.0", "docker.ipamdriver/1.0"},
+			Socket: ovn.DriverName + ".sock",
+		},
+		Network: pluginNetwork{Type: "host"},
+		Linux: pluginLinux{
+			// veth pairs and links are created in the host namespace
+			Capabilities: []string{"CAP_NET_ADMIN", "CAP_SYS_ADMIN"},
+		},
+		Mounts: []pluginMount{
+			{
+				Name:        "ovsdb",
+				Description: "directory of the local Open_vSwitch database socket",
+				Source:      "/var/run/openvswitch",
+				Destination: "/var/run/openvswitch",
+				Type:        "bind",
+				Options:     []string{"rbind"},
+				Settable:    []string{"source"},
+			},
+			{
+				Name:        "docker",
+				Description: "Docker socket, to recover the networks and endpoints of the plugin",
+				Source:      "/var/run/docker.sock",
+				Destination: "/var/run/docker.sock",
+				Type:        "bind",
+				Options:     []string{"rbind"},
+				Settable:    []string{"source"},
+			},
+		},
+	}
+
+	for _, f := range flags {
+		var env pluginEnv
+		switch flag := f.(type) {
+		case cli.StringFlag:
+			env = pluginEnv{Name: flag.EnvVar, Description: flag.Usage, Value: flag.Value}
+		case cli.BoolFlag:
+			env = pluginEnv{Name: flag.EnvVar, Description: flag.Usage, Value: "false"}
+		default:
+			continue
+		}
+		if env.Name == "" {
+			continue
+		}
+		env.Settable = []string{"value"}
+		config.Env = append(config.Env, env)
+	}
+
+	// empty settings keep the value of the config file or the default
+	for _, setting := range ovn.EnvSettings() {
+		var value string
+		if setting.Name == ovn.EnvPrefix+"DRIVER_NAME" {
+			value = name
+		}
+		config.Env = append(config.Env, pluginEnv{
+			Name:        setting.Name,
+			Description: fmt.Sprintf("config setting %s (default %s)", setting.Key, setting.Default),
+			Value:       value,
+			Settable:    []string{"value"},
+		})
+	}
+	return config
+}
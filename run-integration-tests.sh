@@ -70,7 +70,7 @@ function start_ovn_plugin {
 	-v $(pwd)/:/go/src/github.com/huikang/libnetwork-ovn-plugin \
 	-w /go/src/github.com/huikang/libnetwork-ovn-plugin \
 	-v /run:/run \
-	mrjana/golang ./bin/libnetwork-ovn-plugin -d
+	mrjana/golang ./bin/libnetwork-ovn-plugin -d --ovsdb tcp:127.0.0.1:6640
 }
 start_ovn_plugin
 
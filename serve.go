@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/sdk"
+	"github.com/huikang/libnetwork-ovn-plugin/ovn"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// pluginSpecDir is where dockerd discovers plugins that are not served on a
+// unix socket under /run/docker/plugins
+const pluginSpecDir = "/etc/docker/plugins"
+
+var serveFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "plugin-addr",
+		Usage:  "serve the plugin API on this TCP address (IP:PORT) instead of the unix socket /run/docker/plugins/ovn.sock",
+		EnvVar: ovn.EnvPrefix + "PLUGIN_ADDR",
+	},
+	cli.StringFlag{
+		Name:   "plugin-advertise",
+		Usage:  "HOST:PORT dockerd reaches the plugin at, written to the plugin spec file (default: --plugin-addr)",
+		EnvVar: ovn.EnvPrefix + "PLUGIN_ADVERTISE",
+	},
+	cli.StringFlag{
+		Name:   "plugin-tls-cert",
+		Usage:  "certificate file to serve the plugin API over TLS",
+		EnvVar: ovn.EnvPrefix + "PLUGIN_TLS_CERT",
+	},
+	cli.StringFlag{
+		Name:   "plugin-tls-key",
+		Usage:  "private key file to serve the plugin API over TLS",
+		EnvVar: ovn.EnvPrefix + "PLUGIN_TLS_KEY",
+	},
+	cli.StringFlag{
+		Name:   "plugin-tls-ca",
+		Usage:  "CA certificate file that signs the plugin and dockerd certificates; dockerd must present a client certificate when given",
+		EnvVar: ovn.EnvPrefix + "PLUGIN_TLS_CA",
+	},
+	cli.StringFlag{
+		Name:   "plugin-client-cert",
+		Usage:  "client certificate file dockerd presents, written to the plugin spec file",
+		EnvVar: ovn.EnvPrefix + "PLUGIN_CLIENT_CERT",
+	},
+	cli.StringFlag{
+		Name:   "plugin-client-key",
+		Usage:  "client private key file dockerd uses, written to the plugin spec file",
+		EnvVar: ovn.EnvPrefix + "PLUGIN_CLIENT_KEY",
+	},
+}
+
+// specTLSConfig is the TLS configuration dockerd uses to reach the plugin
+type specTLSConfig struct {
+	InsecureSkipVerify bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+}
+
+// pluginSpec is the content of a .json plugin spec file
+type pluginSpec struct {
+	Name      string
+	Addr      string
+	TLSConfig *specTLSConfig `json:",omitempty"`
+}
+
+// servePlugin serves the drivers on the unix socket dockerd looks for, or on
+// a TCP address announced to dockerd through a spec file that is removed
+// when the plugin stops
+func servePlugin(c *cli.Context, h sdk.Handler) error {
+	addr := c.GlobalString("plugin-addr")
+	if addr == "" {
+		return h.ServeUnix(ovn.DriverName, 0)
+	}
+
+	tlsConfig, err := pluginTLSConfig(c)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	advertise := c.GlobalString("plugin-advertise")
+	if advertise == "" {
+		advertise = l.Addr().String()
+	}
+	if host, _, err := net.SplitHostPort(advertise); err != nil {
+		return fmt.Errorf("invalid plugin address [ %s ]: %s", advertise, err)
+	} else if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return fmt.Errorf("plugin address [ %s ] is not reachable by dockerd, set --plugin-advertise", advertise)
+	}
+
+	spec, err := writeSpec(c, advertise, tlsConfig != nil)
+	if err != nil {
+		return err
+	}
+	log.Infof("Serving the plugin on [ %s ], spec file [ %s ]", l.Addr(), spec)
+	remove := func() {
+		if err := os.Remove(spec); err != nil && !os.IsNotExist(err) {
+			log.Errorf("could not remove plugin spec file [ %s ]: %s", spec, err)
+		}
+	}
+	ovn.AtExit(remove)
+	defer remove()
+	return h.Serve(l)
+}
+
+// pluginTLSConfig returns the TLS configuration of the plugin API, or nil
+// when it is served in plain text
+func pluginTLSConfig(c *cli.Context) (*tls.Config, error) {
+	certFile := c.GlobalString("plugin-tls-cert")
+	keyFile := c.GlobalString("plugin-tls-key")
+	caFile := c.GlobalString("plugin-tls-ca")
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			return nil, fmt.Errorf("--plugin-tls-ca needs --plugin-tls-cert and --plugin-tls-key")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("--plugin-tls-cert and --plugin-tls-key must be given together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load plugin certificate: %s", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read plugin CA certificate: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in [ %s ]", caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// writeSpec announces the plugin address to dockerd: a .spec file holding
+// the URL for plain TCP, a .json file that also holds the TLS
+// configuration otherwise
+func writeSpec(c *cli.Context, addr string, useTLS bool) (string, error) {
+	if err := os.MkdirAll(pluginSpecDir, 0755); err != nil {
+		return "", err
+	}
+	url := "tcp://" + addr
+
+	if !useTLS {
+		spec := filepath.Join(pluginSpecDir, ovn.DriverName+".spec")
+		return spec, ioutil.WriteFile(spec, []byte(url), 0644)
+	}
+
+	spec := filepath.Join(pluginSpecDir, ovn.DriverName+".json")
+	data, err := json.MarshalIndent(&pluginSpec{
+		Name: ovn.DriverName,
+		Addr: url,
+		TLSConfig: &specTLSConfig{
+			CAFile:   c.GlobalString("plugin-tls-ca"),
+			CertFile: c.GlobalString("plugin-client-cert"),
+			KeyFile:  c.GlobalString("plugin-client-key"),
+		},
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return spec, ioutil.WriteFile(spec, data, 0644)
+}